@@ -0,0 +1,369 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/serverwentdown/wireguard-negotiator/lib"
+	"github.com/urfave/cli/v2"
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var CmdAgent = &cli.Command{
+	Name:  "agent",
+	Usage: "Keep local WireGuard in sync with the server after request",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "interface",
+			Aliases: []string{"i"},
+			Value:   "wg0",
+			Usage:   "Read default state path for the interface",
+		},
+		&cli.StringFlag{
+			Name:        "state",
+			Value:       "",
+			DefaultText: "/var/lib/wireguard-negotiator/<interface>.json",
+			Usage:       "Path to the state file saved by request",
+		},
+		&cli.DurationFlag{
+			Name:  "punch-interval",
+			Value: 30 * time.Second,
+			Usage: "In mesh mode, update peer endpoints observed by the server at this interval",
+		},
+		&cli.DurationFlag{
+			Name:  "direct-timeout",
+			Value: 3 * time.Minute,
+			Usage: "In mesh mode, route traffic to a peer through the server when no direct handshake completes within this duration",
+		},
+	},
+	Action: runAgent,
+}
+
+const (
+	agentMinBackoff = 5 * time.Second
+	agentMaxBackoff = 5 * time.Minute
+)
+
+func runAgent(ctx *cli.Context) error {
+	inter := ctx.String("interface")
+	statePath := ctx.String("state")
+	if !ctx.IsSet("state") {
+		statePath = lib.DefaultStatePath(inter)
+	}
+
+	state, err := lib.ReadState(statePath)
+	if err != nil {
+		return err
+	}
+	backend, err := stateBackend(state, statePath, 0)
+	if err != nil {
+		return err
+	}
+
+	client, err := stateClient(state)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Agent syncing %v with %v\n", state.InterfaceName, state.ServerURL)
+
+	puncher := &puncher{
+		client:        client,
+		config:        stateConfig(state, state.Config),
+		directTimeout: ctx.Duration("direct-timeout"),
+		attempts:      make(map[string]time.Time),
+		relayed:       make(map[string]bool),
+	}
+	go puncher.run(ctx.Context, ctx.Duration("punch-interval"))
+
+	backoff := agentMinBackoff
+	for {
+		// The key may have been rotated with request --rotate
+		if rotated, ok := rotatedState(statePath, state); ok {
+			log.Println("Key rotated, syncing with the new key")
+			state = rotated
+			puncher.setConfig(stateConfig(state, state.Config))
+		}
+
+		privateKey, err := wgtypes.ParseKey(state.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("state private key not valid: %w", err)
+		}
+		serverPublicKey, err := wgtypes.ParseKey(state.Config.PublicKey)
+		if err != nil {
+			return fmt.Errorf("state server public key not valid: %w", err)
+		}
+
+		resp, changed, err := client.Sync(ctx.Context, privateKey, serverPublicKey, state.Config.Version)
+		// Stopped by SIGINT or SIGTERM
+		if ctx.Context.Err() != nil {
+			return nil
+		}
+		if _, ok := rotatedState(statePath, state); ok && err != nil {
+			// The old key was revoked by the rotation
+			continue
+		}
+		if errors.Is(err, lib.ErrRevoked) {
+			log.Println("Revoked by server, removing local configuration")
+			err = backend.Remove()
+			if err != nil {
+				return err
+			}
+			return os.Remove(statePath)
+		}
+		if err != nil {
+			log.Printf("Sync failed, retrying in %v: %v\n", backoff, err)
+			if !sleep(ctx.Context, backoff) {
+				return nil
+			}
+			backoff *= 2
+			if backoff > agentMaxBackoff {
+				backoff = agentMaxBackoff
+			}
+			continue
+		}
+		backoff = agentMinBackoff
+		if !changed {
+			continue
+		}
+
+		config := stateConfig(state, resp)
+		// Keep peers that are reached through the server relayed
+		err = backend.Write(puncher.relay(config))
+		if err == nil {
+			err = backend.Apply()
+		}
+		if err != nil {
+			// Keep the previous version, so that the change is retried
+			log.Printf("Apply failed, retrying in %v: %v\n", backoff, err)
+			if !sleep(ctx.Context, backoff) {
+				return nil
+			}
+			continue
+		}
+		log.Printf("Applied configuration version %v\n", resp.Version)
+		puncher.setConfig(config)
+
+		// Do not overwrite a rotated key
+		if _, ok := rotatedState(statePath, state); ok {
+			continue
+		}
+		state.Config = resp
+		err = lib.WriteState(statePath, state)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sleep waits for the duration, reporting false if the context is cancelled
+// first
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
+
+// rotatedState rereads the state file, reporting whether the key differs from
+// the given state
+func rotatedState(statePath string, state lib.State) (lib.State, bool) {
+	current, err := lib.ReadState(statePath)
+	if err != nil {
+		return state, false
+	}
+	return current, current.PrivateKey != state.PrivateKey
+}
+
+// stateBackend creates the backend recorded in the state
+func stateBackend(state lib.State, statePath string, verifyTimeout time.Duration) (lib.Backend, error) {
+	return lib.NewBackend(state.Type, lib.BackendOptions{
+		InterfaceName:       state.InterfaceName,
+		ConfigPath:          state.ConfigPath,
+		WireGuardConfigPath: state.WireGuardConfigPath,
+		StatePath:           statePath,
+		TemplateDir:         state.TemplateDir,
+		TemplateCommand:     state.TemplateCommand,
+		VerifyTimeout:       verifyTimeout,
+	})
+}
+
+// stateClient creates a client for the server recorded in the state
+func stateClient(state lib.State) (*lib.Client, error) {
+	return lib.NewClient(state.ServerURL, lib.ClientOptions{
+		Insecure: state.Insecure,
+		CAFile:   state.CAFile,
+		CertFile: state.CertFile,
+		KeyFile:  state.KeyFile,
+		Proxy:    state.Proxy,
+	})
+}
+
+// stateConfig combines the local state with a configuration from the server
+func stateConfig(state lib.State, resp lib.PeerConfigResponse) lib.InterfaceAndPeerConfig {
+	return lib.InterfaceAndPeerConfig{
+		PeerConfigResponse: resp,
+		PrivateKey:         state.PrivateKey,
+		InterfaceName:      state.InterfaceName,
+		ListenPort:         state.ListenPort,
+	}
+}
+
+// puncher helps mesh peers behind NAT establish direct tunnels. Endpoints of
+// peers observed by the server are configured with keepalives, so that both
+// peers send packets to each other and open mappings in their NATs. Peers that
+// do not complete a direct handshake are reached through the server instead,
+// by moving their AllowedIPs, including delegated prefixes, to the server peer
+type puncher struct {
+	sync.Mutex
+	client        *lib.Client
+	config        lib.InterfaceAndPeerConfig
+	directTimeout time.Duration
+	// Start of direct handshake attempts for each peer
+	attempts map[string]time.Time
+	// Peers reached through the server
+	relayed map[string]bool
+}
+
+func (p *puncher) setConfig(config lib.InterfaceAndPeerConfig) {
+	p.Lock()
+	defer p.Unlock()
+	p.config = config
+}
+
+// relay moves the AllowedIPs of peers reached through the server in the
+// config, so that applying a new config keeps them reached through the server
+func (p *puncher) relay(config lib.InterfaceAndPeerConfig) lib.InterfaceAndPeerConfig {
+	p.Lock()
+	defer p.Unlock()
+	return relayConfig(config, p.relayed)
+}
+
+// relayConfig moves the AllowedIPs of relayed peers to the server peer
+func relayConfig(config lib.InterfaceAndPeerConfig, relayed map[string]bool) lib.InterfaceAndPeerConfig {
+	allowedIPs := append([]string{}, config.AllowedIPs...)
+	peers := make([]lib.PeerConfig, 0, len(config.Peers))
+	for _, peer := range config.Peers {
+		if relayed[peer.PublicKey] {
+			allowedIPs = append(allowedIPs, peer.AllowedIPs...)
+			peer.AllowedIPs = nil
+		}
+		peers = append(peers, peer)
+	}
+	config.AllowedIPs = allowedIPs
+	config.Peers = peers
+	return config
+}
+
+func (p *puncher) run(ctx context.Context, interval time.Duration) {
+	for {
+		err := p.punch(ctx)
+		if err != nil {
+			log.Printf("Endpoint update failed: %v\n", err)
+		}
+		if !sleep(ctx, interval) {
+			return
+		}
+	}
+}
+
+func (p *puncher) punch(ctx context.Context) error {
+	// Do not hold the lock while waiting for the server
+	p.Lock()
+	config := p.config
+	p.Unlock()
+
+	if len(config.Peers) == 0 {
+		return nil
+	}
+
+	privateKey, err := wgtypes.ParseKey(config.PrivateKey)
+	if err != nil {
+		return err
+	}
+	serverPublicKey, err := wgtypes.ParseKey(config.PublicKey)
+	if err != nil {
+		return err
+	}
+	peerEndpoints, err := p.client.Endpoints(ctx, privateKey, serverPublicKey)
+	if err != nil {
+		return err
+	}
+	observed := make(map[string]string)
+	for _, peerEndpoint := range peerEndpoints {
+		observed[peerEndpoint.PublicKey] = peerEndpoint.Endpoint
+	}
+
+	wg, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer wg.Close()
+	device, err := wg.Device(config.InterfaceName)
+	if err != nil {
+		return err
+	}
+	lastHandshake := make(map[string]time.Time)
+	for _, peer := range device.Peers {
+		lastHandshake[peer.PublicKey.String()] = peer.LastHandshakeTime
+	}
+
+	now := time.Now()
+	var peers []lib.PeerConfig
+	relayed := make(map[string]bool)
+	p.Lock()
+	for _, peer := range config.Peers {
+		if endpoint, ok := observed[peer.PublicKey]; ok {
+			peer.Endpoint = endpoint
+		}
+		if len(peer.Endpoint) == 0 {
+			continue
+		}
+		peer.PersistentKeepalive = config.PersistentKeepalive
+		peers = append(peers, peer)
+
+		// Handshakes are renewed every 2 minutes while keepalives are sent
+		direct := now.Sub(lastHandshake[peer.PublicKey]) < p.directTimeout
+		if _, ok := p.attempts[peer.PublicKey]; !ok || direct {
+			p.attempts[peer.PublicKey] = now
+		}
+		if !direct && now.Sub(p.attempts[peer.PublicKey]) > p.directTimeout {
+			relayed[peer.PublicKey] = true
+		}
+	}
+	p.relayed = relayed
+	p.Unlock()
+	config.Peers = peers
+	config = relayConfig(config, relayed)
+
+	// Replace the AllowedIPs of the server peer, so that peers that complete a
+	// direct handshake again are no longer reached through the server
+	serverPeer := lib.PeerConfig{
+		PublicKey:           config.PublicKey,
+		AllowedIPs:          config.AllowedIPs,
+		PersistentKeepalive: config.PersistentKeepalive,
+	}
+	wgConfig := wgtypes.Config{}
+	for _, peer := range append([]lib.PeerConfig{serverPeer}, config.Peers...) {
+		peerConfig, err := peer.WireGuardConfig()
+		if err != nil {
+			return err
+		}
+		peerConfig.UpdateOnly = true
+		wgConfig.Peers = append(wgConfig.Peers, peerConfig)
+	}
+
+	err = wg.ConfigureDevice(config.InterfaceName, wgConfig)
+	if err != nil {
+		return fmt.Errorf("configure %s failed: %w", config.InterfaceName, err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/serverwentdown/wireguard-negotiator/lib"
+	"github.com/urfave/cli/v2"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var CmdLeave = &cli.Command{
+	Name:  "leave",
+	Usage: "Deregister from the server and remove local WireGuard configuration",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "interface",
+			Aliases: []string{"i"},
+			Value:   "wg0",
+			Usage:   "Read default state path for the interface",
+		},
+		&cli.StringFlag{
+			Name:        "state",
+			Value:       "",
+			DefaultText: "/var/lib/wireguard-negotiator/<interface>.json",
+			Usage:       "Path to the state file saved by request",
+		},
+		&cli.BoolFlag{
+			Name:  "force",
+			Value: false,
+			Usage: "Remove local configuration even if the server cannot be reached",
+		},
+	},
+	Action: runLeave,
+}
+
+func runLeave(ctx *cli.Context) error {
+	inter := ctx.String("interface")
+	statePath := ctx.String("state")
+	if !ctx.IsSet("state") {
+		statePath = lib.DefaultStatePath(inter)
+	}
+
+	state, err := lib.ReadState(statePath)
+	if err != nil {
+		return err
+	}
+	privateKey, err := wgtypes.ParseKey(state.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("state private key not valid: %w", err)
+	}
+	serverPublicKey, err := wgtypes.ParseKey(state.Config.PublicKey)
+	if err != nil {
+		return fmt.Errorf("state server public key not valid: %w", err)
+	}
+	backend, err := stateBackend(state, statePath, 0)
+	if err != nil {
+		return err
+	}
+
+	// Deregister first, so that a failure leaves the client working
+	client, err := stateClient(state)
+	if err != nil {
+		return err
+	}
+	err = client.Leave(ctx.Context, privateKey, serverPublicKey)
+	if errors.Is(err, lib.ErrRevoked) {
+		log.Println("Peer already removed from the server")
+	} else if err != nil {
+		if !ctx.Bool("force") {
+			return fmt.Errorf("%w, use --force to remove local configuration anyway", err)
+		}
+		log.Printf("WARNING: Deregistration failed, removing local configuration anyway: %v\n", err)
+	}
+
+	err = backend.Remove()
+	if err != nil {
+		return err
+	}
+	err = os.Remove(statePath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Left %v and removed %v\n", state.ServerURL, state.InterfaceName)
+	return nil
+}
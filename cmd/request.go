@@ -1,17 +1,19 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"os"
-	"os/exec"
-	"text/template"
+	"path/filepath"
+	"time"
 
 	"github.com/serverwentdown/wireguard-negotiator/lib"
 	"github.com/urfave/cli/v2"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
-var ErrTypeNotValid = fmt.Errorf("network interface backend type not valid")
+var ErrServerRequired = fmt.Errorf("server URL is required")
 
 var CmdRequest = &cli.Command{
 	Name:   "request",
@@ -38,142 +40,430 @@ var CmdRequest = &cli.Command{
 			DefaultText: "/etc/systemd/network/<interface>",
 			Usage:       "Path to save networkd configuration. Appends .netdev and .network extensions",
 		},
+		&cli.StringFlag{
+			Name:        "networkmanager",
+			Value:       "",
+			DefaultText: "/etc/NetworkManager/system-connections/<interface>.nmconnection",
+			Usage:       "Path to save NetworkManager connection keyfile",
+		},
+		&cli.StringFlag{
+			Name:        "ifupdown",
+			Value:       "",
+			DefaultText: "/etc/network/interfaces.d/<interface>",
+			Usage:       "Path to save ifupdown interface configuration. The WireGuard configuration file is saved to the path given by --none",
+		},
+		&cli.StringFlag{
+			Name:        "netplan",
+			Value:       "",
+			DefaultText: "/etc/netplan/90-<interface>.yaml",
+			Usage:       "Path to save netplan configuration",
+		},
+		&cli.StringFlag{
+			Name:        "uci",
+			Value:       "",
+			DefaultText: "/etc/config/network",
+			Usage:       "Path of the uci network configuration file, made readable only by root as it holds the private key",
+		},
+		&cli.StringFlag{
+			Name:        "template",
+			Value:       "",
+			DefaultText: "/etc/wireguard",
+			Usage:       "Directory to save files rendered by the template backend",
+		},
+		&cli.StringFlag{
+			Name:  "template-dir",
+			Usage: "Directory of text/template files. Files named after built-in templates replace them, and all files are rendered by the template backend",
+		},
+		&cli.StringFlag{
+			Name:  "template-command",
+			Usage: "Shell command run by the template backend after writing files",
+		},
 		&cli.StringFlag{
 			Name:    "type",
 			Aliases: []string{"t"},
 			Value:   "networkd",
-			Usage:   "Select network interface backend. Currently only networkd is implemented",
+			Usage:   "Select network interface backend: networkd, networkmanager, ifupdown, netplan, uci, userspace or template",
+		},
+		&cli.StringFlag{
+			Name:        "pidfile",
+			Value:       "",
+			DefaultText: "/run/wireguard-negotiator/<interface>.pid",
+			Usage:       "Path to save the process ID of the userspace daemon",
+		},
+		&cli.BoolFlag{
+			Name:    "foreground",
+			Aliases: []string{"f"},
+			Usage:   "Keep the userspace interface running in the foreground instead of daemonizing",
+		},
+		&cli.StringFlag{
+			Name:    "server",
+			Aliases: []string{"s"},
+			Usage:   "wireguard-negotiator server URL. Required unless rotating",
+			EnvVars: []string{"WGN_SERVER_URL"},
+		},
+		&cli.DurationFlag{
+			Name:  "verify-timeout",
+			Value: lib.DefaultVerifyTimeout,
+			Usage: "Roll back the configuration if the interface does not come up with its addresses within this duration. 0 skips the check",
+		},
+		&cli.DurationFlag{
+			Name:  "connect-timeout",
+			Value: lib.DefaultConnectTimeout,
+			Usage: "Fail if no handshake with the server completes and the server is not reachable through the tunnel within this duration. 0 skips the check",
+		},
+		&cli.BoolFlag{
+			Name:  "rotate",
+			Usage: "Replace the key of the interface set up by an earlier request, keeping its addresses. Reads the server and backend from the state file, so it can run from cron",
 		},
 		&cli.StringFlag{
-			Name:     "server",
-			Aliases:  []string{"s"},
-			Usage:    "wireguard-negotiator server URL",
-			Required: true,
-			EnvVars:  []string{"WGN_SERVER_URL"},
+			Name:        "state",
+			Value:       "",
+			DefaultText: "/var/lib/wireguard-negotiator/<interface>.json",
+			Usage:       "Path to save the state file used by the agent",
 		},
 		&cli.BoolFlag{
 			Name:    "insecure",
 			Usage:   "Disable TLS verification",
 			EnvVars: []string{"WGN_SERVER_INSECURE"},
 		},
+		&cli.StringFlag{
+			Name:    "ca-file",
+			Usage:   "Verify the server with the certificate authorities in this PEM file instead of the system roots",
+			EnvVars: []string{"WGN_SERVER_CA_FILE"},
+		},
+		&cli.StringFlag{
+			Name:  "cert-file",
+			Usage: "Present the certificate in this PEM file to the server",
+		},
+		&cli.StringFlag{
+			Name:  "key-file",
+			Usage: "Path to the PEM key of --cert-file",
+		},
+		&cli.StringFlag{
+			Name:  "proxy",
+			Usage: "Connect to the server through this proxy URL instead of the proxy from the environment",
+		},
+		&cli.IntFlag{
+			Name:    "listen-port",
+			Aliases: []string{"p"},
+			Usage:   "Listen on a fixed port, so that other peers can reach this client in mesh mode",
+		},
+		&cli.StringFlag{
+			Name:  "endpoint",
+			Usage: "Report this endpoint address to the server, so that other peers can reach this client in mesh mode",
+		},
+		&cli.IntFlag{
+			Name:  "delegate-prefix",
+			Usage: "Request a routed prefix of this length from the server delegation pool, for clients that route a LAN",
+		},
+		&cli.StringSliceFlag{
+			Name:  "advertise-prefix",
+			Usage: "Advertise an existing LAN prefix in CIDR notation to be routed to this client. Must be within the server delegation pool",
+		},
 	},
 }
 
+// configPathFlags are the flags that set the configuration path of each
+// backend
+var configPathFlags = map[string]string{
+	"networkd":       "networkd",
+	"networkmanager": "networkmanager",
+	"ifupdown":       "ifupdown",
+	"netplan":        "netplan",
+	"uci":            "uci",
+	"template":       "template",
+	"userspace":      "pidfile",
+}
+
+// absPath makes a path from a flag absolute, so that it still works when the
+// state file is read from another directory. Empty paths stay empty
+func absPath(path string) string {
+	if path == "" {
+		return ""
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return abs
+}
+
 func runRequest(ctx *cli.Context) error {
 	inter := ctx.String("interface")
 	netBackend := ctx.String("type")
-	/*
-		noneConfig := ctx.String("none")
-		if !ctx.IsSet("none") {
-			noneConfig = "/etc/wireguard/" + inter + ".conf"
-		}
-	*/
-	networkdConfig := ctx.String("networkd")
-	if !ctx.IsSet("networkd") {
-		networkdConfig = "/etc/systemd/network/" + inter
+	statePath := ctx.String("state")
+	if !ctx.IsSet("state") {
+		statePath = lib.DefaultStatePath(inter)
+	}
+	if ctx.Bool("rotate") {
+		return runRotate(ctx, statePath)
 	}
 
-	client := lib.NewClient(ctx.String("server"), ctx.Bool("insecure"))
+	// Resume waiting for a request submitted by an earlier run, which was
+	// interrupted before the server decided, or apply again a request that
+	// was approved but failed to apply
+	state, err := lib.ReadState(statePath)
+	resuming := err == nil && state.RequestID != ""
+	approved := err == nil && state.RequestID == "" && state.Config.PublicKey != ""
+	if !resuming && !approved {
+		if ctx.String("server") == "" {
+			return ErrServerRequired
+		}
+		var configPath, wireGuardConfigPath string
+		if flag, ok := configPathFlags[netBackend]; ok {
+			configPath = ctx.String(flag)
+		}
+		if netBackend == "ifupdown" {
+			wireGuardConfigPath = ctx.String("none")
+		}
+
+		// Generate the private key
+		privateKey, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return err
+		}
+
+		state = lib.State{
+			ServerURL:           ctx.String("server"),
+			Insecure:            ctx.Bool("insecure"),
+			CAFile:              absPath(ctx.String("ca-file")),
+			CertFile:            absPath(ctx.String("cert-file")),
+			KeyFile:             absPath(ctx.String("key-file")),
+			Proxy:               ctx.String("proxy"),
+			InterfaceName:       inter,
+			Type:                netBackend,
+			PrivateKey:          privateKey.String(),
+			ListenPort:          ctx.Int("listen-port"),
+			Endpoint:            ctx.String("endpoint"),
+			ConfigPath:          configPath,
+			WireGuardConfigPath: wireGuardConfigPath,
+			TemplateDir:         ctx.String("template-dir"),
+			TemplateCommand:     ctx.String("template-command"),
+		}
+	}
+	privateKey, err := wgtypes.ParseKey(state.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("state private key not valid: %w", err)
+	}
 
-	// Generate the private key and public key
-	privateKey, err := wgtypes.GeneratePrivateKey()
+	backend, err := lib.NewBackend(state.Type, lib.BackendOptions{
+		InterfaceName:       state.InterfaceName,
+		ConfigPath:          state.ConfigPath,
+		WireGuardConfigPath: state.WireGuardConfigPath,
+		StatePath:           statePath,
+		Foreground:          ctx.Bool("foreground"),
+		TemplateDir:         state.TemplateDir,
+		TemplateCommand:     state.TemplateCommand,
+		VerifyTimeout:       requestVerifyTimeout(ctx),
+	})
 	if err != nil {
 		return err
 	}
-	publicKey := privateKey.PublicKey()
 
-	// Ensure that given files can be opened
-	var netdevFile, networkFile *os.File
-	switch netBackend {
-	case "networkd":
-		netdevFile, err = os.OpenFile(networkdConfig+".netdev", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
-		if err != nil {
-			return fmt.Errorf("opening %s failed: %w", networkdConfig+".netdev", err)
-		}
-		networkFile, err = os.OpenFile(networkdConfig+".network", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
-		if err != nil {
-			return fmt.Errorf("opening %s failed: %w", networkdConfig+".network", err)
-		}
-	default:
-		return fmt.Errorf("%w: %s", ErrTypeNotValid, netBackend)
+	client, err := stateClient(state)
+	if err != nil {
+		return err
 	}
 
-	// Perform the request
-	peerConfigResponse, err := client.Request(publicKey.String())
+	// Ensure that the interface is not already configured
+	err = backend.Prepare()
 	if err != nil {
 		return err
 	}
-	config := interfaceAndPeerConfig{
-		peerConfigResponse,
-		privateKey.String(),
-		inter,
+
+	// Submit the request, saving its ID and the private key so that waiting
+	// can be resumed
+	request := lib.PeerConfigRequest{
+		PublicKey:            privateKey.PublicKey().String(),
+		Endpoint:             state.Endpoint,
+		DelegatePrefixLength: ctx.Int("delegate-prefix"),
+		AdvertisedPrefixes:   ctx.StringSlice("advertise-prefix"),
 	}
+	if approved {
+		fmt.Println("Applying approved request")
+	} else {
+		peerConfigResponse, err := waitRequest(ctx, client, statePath, state, request, resuming)
+		if err != nil {
+			return err
+		}
+		for _, prefix := range peerConfigResponse.DelegatedPrefixes {
+			fmt.Printf("Delegated prefix %v\n", prefix)
+		}
 
-	// Generate configuration
-	switch netBackend {
-	case "networkd":
-		err = configureNetworkd(config, netdevFile, networkFile)
+		// Save the approved state, for the agent and so that a failure below
+		// can be retried without another request
+		state.RequestID = ""
+		state.Config = peerConfigResponse
+		err = lib.WriteState(statePath, state)
 		if err != nil {
 			return err
 		}
-	default:
-		return fmt.Errorf("%w: %s", ErrTypeNotValid, netBackend)
 	}
+	config := stateConfig(state, state.Config)
 
-	return nil
-}
+	// Generate configuration
+	err = backend.Write(config)
+	if err == nil {
+		err = backend.Apply()
+	}
+	if err != nil {
+		return rollback(backend, fmt.Errorf("%w, run request again to retry", err))
+	}
 
-type interfaceAndPeerConfig struct {
-	lib.PeerConfigResponse
-	PrivateKey    string
-	InterfaceName string
+	return verifyConnection(ctx, state.Type, state.TemplateCommand, config)
 }
 
-const networkdNetdevTemplate = `
-[NetDev]
-Name = {{.InterfaceName}}
-Kind = wireguard
-Description = WireGuard {{.InterfaceName}} generated with wireguard-negotiator
+// waitRequest submits the request, or resumes waiting for it, until the
+// server decides. Decided requests that were not approved remove the state
+func waitRequest(ctx *cli.Context, client *lib.Client, statePath string, state lib.State, request lib.PeerConfigRequest, resuming bool) (lib.PeerConfigResponse, error) {
+	// Older servers respond once the request is decided, so waiting cannot be
+	// resumed
+	var err error
+	synchronous := false
+	if resuming {
+		fmt.Printf("Resuming request %v\n", state.RequestID)
+	} else {
+		state.RequestID, err = client.Submit(ctx.Context, request)
+		synchronous = errors.Is(err, lib.ErrAsyncUnsupported)
+		if err != nil && !synchronous {
+			return lib.PeerConfigResponse{}, err
+		}
+		if !synchronous {
+			err = lib.WriteState(statePath, state)
+			if err != nil {
+				return lib.PeerConfigResponse{}, err
+			}
+		}
+	}
 
-[WireGuard]
-PrivateKey = {{.PrivateKey}}
+	var peerConfigResponse lib.PeerConfigResponse
+	if synchronous {
+		fmt.Println("Waiting for approval")
+		peerConfigResponse, err = client.Request(ctx.Context, request)
+	} else {
+		fmt.Printf("Waiting for approval of request %v\n", state.RequestID)
+		peerConfigResponse, err = client.Wait(ctx.Context, state.RequestID)
+	}
+	if errors.Is(err, lib.ErrRejected) || errors.Is(err, lib.ErrExpired) || errors.Is(err, lib.ErrCancelled) || errors.Is(err, lib.ErrRequestNotFound) {
+		os.Remove(statePath)
+		return peerConfigResponse, err
+	}
+	if err != nil {
+		return peerConfigResponse, fmt.Errorf("%w, run request again to resume waiting", err)
+	}
+	return peerConfigResponse, nil
+}
 
-[WireGuardPeer]
-PublicKey = {{.PublicKey}}
-AllowedIPs = {{range $i, $a := .AllowedIPs}}{{if gt $i 0}}, {{end}}{{.}}{{end}}
-Endpoint = {{.Endpoint}}
-PersistentKeepalive = {{.PersistentKeepalive}}
-`
+// runRotate replaces the key of the interface in the state file. The server
+// keeps the addresses of the peer, and the backend files are rewritten in
+// place
+func runRotate(ctx *cli.Context, statePath string) error {
+	state, err := lib.ReadState(statePath)
+	if err != nil {
+		return err
+	}
+	privateKey, err := wgtypes.ParseKey(state.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("state private key not valid: %w", err)
+	}
+	serverPublicKey, err := wgtypes.ParseKey(state.Config.PublicKey)
+	if err != nil {
+		return fmt.Errorf("state server public key not valid: %w", err)
+	}
+	backend, err := stateBackend(state, statePath, requestVerifyTimeout(ctx))
+	if err != nil {
+		return err
+	}
 
-const networkdNetworkTemplate = `
-[Match]
-Name = {{.InterfaceName}}
+	client, err := stateClient(state)
+	if err != nil {
+		return err
+	}
 
-[Network]
-{{range $i, $a := .InterfaceIPs}}
-Address = {{.}}
-{{end}}
-`
+	// Save the new key before sending it, so that it is not lost if the
+	// server accepts it but the response never arrives
+	resuming := state.PendingPrivateKey != ""
+	if !resuming {
+		newPrivateKey, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			return err
+		}
+		state.PendingPrivateKey = newPrivateKey.String()
+		err = lib.WriteState(statePath, state)
+		if err != nil {
+			return err
+		}
+	}
+	newPrivateKey, err := wgtypes.ParseKey(state.PendingPrivateKey)
+	if err != nil {
+		return fmt.Errorf("state pending private key not valid: %w", err)
+	}
 
-func configureNetworkd(config interfaceAndPeerConfig, netdevFile *os.File, networkFile *os.File) error {
-	// For ease of maintenance, just render a textual template
-	netdevTemplate := template.Must(template.New("networkd-netdev").Parse(networkdNetdevTemplate))
-	networkTemplate := template.Must(template.New("networkd-network").Parse(networkdNetworkTemplate))
+	resp, err := client.Rotate(ctx.Context, privateKey, serverPublicKey, newPrivateKey.PublicKey())
+	if resuming && errors.Is(err, lib.ErrRevoked) {
+		// An earlier rotation was accepted, so fetch the config with the
+		// new key
+		resp, _, err = client.Sync(ctx.Context, newPrivateKey, serverPublicKey, 0)
+	}
+	if err != nil {
+		return err
+	}
 
-	err := netdevTemplate.Execute(netdevFile, config)
+	// The old key no longer works, so save the new key first
+	state.PrivateKey = state.PendingPrivateKey
+	state.PendingPrivateKey = ""
+	state.Config = resp
+	err = lib.WriteState(statePath, state)
 	if err != nil {
-		return fmt.Errorf("netdev template: %w", err)
+		return err
+	}
+	// The previous configuration holds the revoked key, so it is not
+	// restored. Rotating again rewrites the configuration
+	config := stateConfig(state, resp)
+	err = backend.Write(config)
+	if err == nil {
+		err = backend.Apply()
 	}
-	err = networkTemplate.Execute(networkFile, config)
 	if err != nil {
-		return fmt.Errorf("network template: %w", err)
+		return fmt.Errorf("new key saved to %s, but applying it failed: %w", statePath, err)
+	}
+	fmt.Printf("Rotated to public key %v\n", newPrivateKey.PublicKey())
+
+	return verifyConnection(ctx, state.Type, state.TemplateCommand, config)
+}
+
+func requestVerifyTimeout(ctx *cli.Context) time.Duration {
+	verifyTimeout := ctx.Duration("verify-timeout")
+	if verifyTimeout == 0 {
+		return -1
 	}
+	return verifyTimeout
+}
 
-	// For now, simply run one fixed command to reread from the config file
-	cmd := exec.Command("systemctl", "restart", "systemd-networkd")
-	err = cmd.Run()
+// verifyConnection checks that the tunnel works after it is set up
+func verifyConnection(ctx *cli.Context, netBackend string, templateCommand string, config lib.InterfaceAndPeerConfig) error {
+	// A foreground userspace interface has already been stopped, and the
+	// template backend might not create an interface
+	connectTimeout := ctx.Duration("connect-timeout")
+	if connectTimeout == 0 || netBackend == "userspace" && ctx.Bool("foreground") || netBackend == "template" && templateCommand == "" {
+		return nil
+	}
+	err := lib.VerifyConnection(config.InterfaceName, config.PeerConfigResponse, connectTimeout)
 	if err != nil {
-		return fmt.Errorf("systemctl restart systemd-networkd failed: %w", err)
+		return err
+	}
+	fmt.Printf("Handshake with server completed\n")
+	if config.PingURL != "" {
+		fmt.Printf("Server %v reachable through the tunnel\n", config.ServerIP)
 	}
 	return nil
 }
+
+// rollback undoes a failed backend setup, returning the original error
+func rollback(backend lib.Backend, err error) error {
+	rollbackErr := backend.Rollback()
+	if rollbackErr != nil {
+		log.Printf("WARNING: rollback failed: %v\n", rollbackErr)
+	}
+	return err
+}
@@ -1,27 +1,19 @@
 package cmd
 
 import (
-	"bufio"
-	"context"
-	"encoding/json"
 	"fmt"
-	"io"
-	"log"
 	"net"
-	"net/http"
 	"os"
 	"os/exec"
-	"os/signal"
-	"syscall"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/serverwentdown/wireguard-negotiator/lib"
 	"github.com/urfave/cli/v2"
-	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
-	"gopkg.in/ini.v1"
 )
 
-var ErrNoAddressesFound = fmt.Errorf("No address found on the interface")
-
 var CmdServer = &cli.Command{
 	Name:  "server",
 	Usage: "Start the wireguard-negotiator server",
@@ -40,11 +32,10 @@ var CmdServer = &cli.Command{
 			Usage:       "Path to the existing WireGuard configuration file. WARNING: wireguard-negotiator will remove any comments in the file",
 		},
 		&cli.StringFlag{
-			Name:     "endpoint",
-			Aliases:  []string{"e"},
-			Value:    "",
-			Required: true,
-			Usage:    "Set the endpoint address",
+			Name:    "endpoint",
+			Aliases: []string{"e"},
+			Value:   "",
+			Usage:   "Set the endpoint address. Required",
 		},
 		&cli.StringFlag{
 			Name:    "listen",
@@ -57,6 +48,74 @@ var CmdServer = &cli.Command{
 			Aliases: []string{"I"},
 			Usage:   "Enable interactive prompt before accepting new peers",
 		},
+		&cli.StringSliceFlag{
+			Name:  "delegation-pool",
+			Usage: "Delegate routed prefixes to clients from this pool in CIDR notation. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "route",
+			Usage: "Push a route in CIDR notation to clients. Can be specified multiple times",
+		},
+		&cli.BoolFlag{
+			Name:  "full-tunnel",
+			Usage: "Push default routes 0.0.0.0/0 and ::/0 to clients, routing all traffic through the tunnel",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns",
+			Usage: "Push a DNS server address to clients. Can be specified multiple times",
+		},
+		&cli.StringSliceFlag{
+			Name:  "dns-search",
+			Usage: "Push a DNS search domain to clients. Can be specified multiple times",
+		},
+		&cli.IntFlag{
+			Name:  "mtu",
+			Usage: "Push an interface MTU to clients",
+		},
+		&cli.BoolFlag{
+			Name:  "mesh",
+			Usage: "Return every other peer to clients, so that clients configure direct tunnels to each other",
+		},
+		&cli.DurationFlag{
+			Name:  "pending-ttl",
+			Value: 24 * time.Hour,
+			Usage: "Expire requests that are not approved within this duration. 0 keeps requests pending until decided",
+		},
+		&cli.StringFlag{
+			Name:        "requests",
+			Value:       "",
+			DefaultText: "/var/lib/wireguard-negotiator/server-<interface>-requests.json",
+			Usage:       "Path to save pending requests, so that they survive a restart",
+		},
+		&cli.BoolFlag{
+			Name:  "preshared-key",
+			Usage: "Generate a preshared key for each new peer, as an additional layer of symmetric encryption",
+		},
+		&cli.BoolFlag{
+			Name:  "userspace",
+			Usage: "Create the interface with userspace WireGuard, for hosts without the kernel module",
+		},
+		&cli.StringSliceFlag{
+			Name:  "address",
+			Usage: "Assign this address in CIDR notation to the userspace interface. Can be specified multiple times",
+		},
+		&cli.BoolFlag{
+			Name:  "apply-on-start",
+			Usage: "Apply the WireGuard configuration file to the interface on start, equivalent to wg setconf",
+		},
+		&cli.DurationFlag{
+			Name:  "reconcile-interval",
+			Value: 5 * time.Minute,
+			Usage: "Compare the configuration file with the interface at this interval, logging differences. 0 disables",
+		},
+		&cli.BoolFlag{
+			Name:  "converge",
+			Usage: "Change the interface to match the configuration file when they differ",
+		},
+		&cli.BoolFlag{
+			Name:  "adopt-live",
+			Usage: "Add peers added with wg set to the configuration file, and update peers that differ. Peers missing on the interface are only logged",
+		},
 		&cli.BoolFlag{
 			Name:    "bin",
 			Aliases: []string{"B"},
@@ -64,306 +123,228 @@ var CmdServer = &cli.Command{
 		},
 	},
 	Action: runServer,
+	Subcommands: []*cli.Command{
+		cmdServerInit,
+	},
 }
 
-type request struct {
-	publicKey string
-	ip        net.IP
+var cmdServerInit = &cli.Command{
+	Name:  "init",
+	Usage: "Create a new WireGuard interface and configuration file for the server",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "interface",
+			Aliases: []string{"i"},
+			Value:   "wg0",
+			Usage:   "The WireGuard interface to create",
+		},
+		&cli.StringFlag{
+			Name:        "config",
+			Aliases:     []string{"c"},
+			Value:       "",
+			DefaultText: "/etc/wireguard/<interface>.conf",
+			Usage:       "Path to write the WireGuard configuration file",
+		},
+		&cli.StringFlag{
+			Name:     "subnet",
+			Required: true,
+			Usage:    "Address of the interface in CIDR notation, such as 10.90.0.1/24. Clients are assigned addresses in this network",
+		},
+		&cli.IntFlag{
+			Name:  "listen-port",
+			Value: 51820,
+			Usage: "Port for WireGuard to listen on",
+		},
+		&cli.BoolFlag{
+			Name:  "networkd",
+			Usage: "Write systemd-networkd units for the interface, so that it is created again on boot",
+		},
+		&cli.StringFlag{
+			Name:    "endpoint",
+			Aliases: []string{"e"},
+			Value:   "",
+			Usage:   "Public address of this host, to print the commands to start the server and enroll clients",
+		},
+		&cli.StringFlag{
+			Name:    "listen",
+			Aliases: []string{"l"},
+			Value:   ":8080",
+			Usage:   "Address the server will listen on, to print the commands to start the server and enroll clients",
+		},
+	},
+	Action: runServerInit,
 }
 
 func runServer(ctx *cli.Context) error {
+	// Checked here, as required flags would also be required for init
+	if !ctx.IsSet("endpoint") {
+		return fmt.Errorf("Required flag \"endpoint\" not set")
+	}
 	inter := ctx.String("interface")
 	config := ctx.String("config")
 	if !ctx.IsSet("config") {
 		config = "/etc/wireguard/" + inter + ".conf"
 	}
-	endpoint := ctx.String("endpoint")
-	listen := ctx.String("listen")
-	interactive := ctx.Bool("interactive")
 
-	// Obtain the network interface
-	interf, err := net.InterfaceByName(inter)
-	if err != nil {
-		return err
+	var delegationPools []net.IPNet
+	for _, pool := range ctx.StringSlice("delegation-pool") {
+		_, poolIPNet, err := net.ParseCIDR(pool)
+		if err != nil {
+			return fmt.Errorf("delegation pool %v not valid: %w", pool, err)
+		}
+		delegationPools = append(delegationPools, *poolIPNet)
 	}
-
-	// Obtain the server's public key
-	serverPublicKey, err := configReadInterfacePublicKey(config)
-	if err != nil {
-		return err
+	routes := ctx.StringSlice("route")
+	if ctx.Bool("full-tunnel") {
+		routes = append(routes, "0.0.0.0/0", "::/0")
 	}
-
-	// TODO: Define this allocation method
-	// TODO: Include allocation behaviour in README
-	terribleCounterThatShouldNotExist := 1
-	interfAddrs, err := interf.Addrs()
-	if err != nil {
-		return err
+	requestsPath := ctx.String("requests")
+	if !ctx.IsSet("requests") {
+		requestsPath = filepath.Join(lib.StateDir, "server-"+inter+"-requests.json")
 	}
-
-	// Obtain interface address for use in allocation
-	var interfIPNet *net.IPNet
-	if len(interfAddrs) < 1 {
-		return ErrNoAddressesFound
+	reconcile := lib.ReconcileLog
+	if ctx.Bool("converge") && ctx.Bool("adopt-live") {
+		return fmt.Errorf("--converge and --adopt-live cannot be used together")
 	}
-	_, interfIPNet, err = net.ParseCIDR(interfAddrs[0].String())
-
-	// Set up interactive stuff
-	lineReader := bufio.NewReader(os.Stdin)
-	if !interactive {
-		lineReader = nil
+	if ctx.Bool("converge") {
+		reconcile = lib.ReconcileDevice
 	}
-
-	addQueue := make(chan request, 0)
-	go adder(addQueue, inter, config)
-
-	gateQueue := make(chan request, 0)
-	go gater(gateQueue, addQueue, lineReader)
-
-	// TODO: Rate limiting
-
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "GET":
-			bin, err := os.Executable()
-			if err != nil {
-				w.WriteHeader(500)
-				return
-			}
-			file, err := os.Open(bin)
-			if err != nil {
-				w.WriteHeader(500)
-				return
-			}
-			_, err = io.Copy(w, file)
-			if err != nil {
-				log.Println("WARNING: Write binary executable to response failed")
-				return
-			}
-		default:
-			w.WriteHeader(405)
-		}
-	})
-	http.HandleFunc("/request", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case "POST":
-			publicKey := r.PostFormValue("PublicKey")
-			// TODO: Ensure public key is new
-			// TODO: Validate public key
-			if len(publicKey) == 0 {
-				w.WriteHeader(400)
-				return
-			}
-
-			// Assign an IP address
-			terribleCounterThatShouldNotExist += 1
-			ip := incrementIP(interfIPNet.IP, terribleCounterThatShouldNotExist)
-			if !interfIPNet.Contains(ip) {
-				log.Println("WARNING: Ran out of addresses to allocate")
-				w.WriteHeader(500)
-				return
-			}
-
-			// Enqueue request into the gate
-			req := request{
-				ip:        ip,
-				publicKey: publicKey,
-			}
-
-			// Wait for flush of configuration
-			gateQueue <- req
-
-			// Produce configuration to client
-			ipNet := &net.IPNet{
-				IP:   ip,
-				Mask: interfIPNet.Mask,
-			}
-			netIPNet := &net.IPNet{
-				IP:   interfIPNet.IP.Mask(interfIPNet.Mask),
-				Mask: interfIPNet.Mask,
-			}
-			resp := lib.PeerConfigResponse{
-				[]string{ipNet.String()},
-				[]string{netIPNet.String()},
-				serverPublicKey,
-				endpoint,
-				25,
-			}
-
-			w.Header().Set("Content-Type", "application/json")
-			json.NewEncoder(w).Encode(resp)
-		default:
-			w.WriteHeader(405)
-		}
+	if ctx.Bool("adopt-live") {
+		reconcile = lib.ReconcileConfig
+	}
+	var gate lib.Gate = lib.GateFunc(func(req lib.EnrollmentRequest) (bool, error) {
+		fmt.Println(req.IP.String(), req.PublicKey)
+		return true, nil
 	})
-
-	server := &http.Server{
-		Addr:    listen,
-		Handler: http.DefaultServeMux,
+	if ctx.Bool("interactive") {
+		gate = lib.NewPromptGate(os.Stdin, os.Stdout)
 	}
 
-	// Shutdown notifier
-	go func() {
-		sigint := make(chan os.Signal, 1)
-		signal.Notify(sigint, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
-		<-sigint
-		close(gateQueue)
-		close(addQueue)
-		if err := server.Shutdown(context.Background()); err != nil {
-			log.Printf("Server shutdown error: %v\n", err)
+	// Create the userspace interface
+	if ctx.Bool("userspace") {
+		dev, err := startUserspaceServer(inter, config, ctx.StringSlice("address"))
+		if err != nil {
+			return err
 		}
-	}()
+		defer dev.Close()
+	} else if _, err := net.InterfaceByName(inter); err != nil {
+		return fmt.Errorf("interface %s not found, create it with server init: %w", inter, err)
+	}
 
-	log.Printf("Server listening on %v\n", listen)
+	server, err := lib.NewServer(lib.ServerOptions{
+		InterfaceName:     inter,
+		ConfigPath:        config,
+		Endpoint:          ctx.String("endpoint"),
+		Listen:            ctx.String("listen"),
+		DelegationPools:   delegationPools,
+		Routes:            routes,
+		DNS:               ctx.StringSlice("dns"),
+		DNSSearch:         ctx.StringSlice("dns-search"),
+		MTU:               ctx.Int("mtu"),
+		Mesh:              ctx.Bool("mesh"),
+		PendingTTL:        ctx.Duration("pending-ttl"),
+		PresharedKeys:     ctx.Bool("preshared-key"),
+		ServeBinary:       ctx.Bool("bin"),
+		ApplyOnStart:      ctx.Bool("apply-on-start"),
+		ReconcileInterval: ctx.Duration("reconcile-interval"),
+		Reconcile:         reconcile,
+		Gate:              gate,
+		Store:             lib.FileStore{Path: requestsPath},
+	})
+	if err != nil {
+		return err
+	}
 
-	return server.ListenAndServe()
+	// The context is done on SIGINT or SIGTERM
+	return server.Run(ctx.Context)
 }
 
-func adder(queue chan request, inter string, config string) {
-	// Write requests to config and add peer
-	for {
-		select {
-		case req, ok := <-queue:
-			if !ok {
-				break
-			}
-			err := configAddPeer(config, req)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			err = interAddPeer(inter, req, config)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-		}
+func runServerInit(ctx *cli.Context) error {
+	inter := ctx.String("interface")
+	subnetIP, subnet, err := net.ParseCIDR(ctx.String("subnet"))
+	if err != nil {
+		return fmt.Errorf("subnet %v not valid: %w", ctx.String("subnet"), err)
 	}
-}
-
-func gater(queue chan request, result chan request, lineReader *bufio.Reader) {
-	// Receive requests and prompt the admin
-	for {
-		select {
-		case req, ok := <-queue:
-			if !ok {
-				return
-			}
-			fmt.Println(req.ip.String(), req.publicKey)
-
-			done := false
-			allowed := false
-
-			if lineReader == nil {
-				done = true
-				allowed = true
-			}
-
-			for !done {
-				fmt.Print("Allow? (y/n) ")
-				line, err := lineReader.ReadString('\n')
-				if err != nil {
-					log.Println(err)
-					return
-				}
-
-				switch line[:len(line)-1] {
-				case "y", "yes":
-					done = true
-					allowed = true
-				case "n", "no":
-					done = true
-					allowed = false
-				}
-			}
-
-			if allowed {
-				result <- req
-			}
-		}
+	if subnetIP.Equal(subnet.IP) {
+		return fmt.Errorf("subnet %v is the network address, use the address of the interface such as %v", ctx.String("subnet"), firstAddress(*subnet))
 	}
-}
-
-func configAddPeer(config string, req request) error {
-	// For every request, open the config file again and rewrite it. Acceptable
-	// because this happens infrequently
-
-	// Preferably in the future, treat the configuration as a database
-
-	// For now, append to the config file
-	cfg := ini.Empty()
-	sec, _ := cfg.NewSection("Peer")
-	publicKey := sec.Key("PublicKey")
-	// TODO: Validation is needed
-	publicKey.SetValue(req.publicKey)
-	allowedIPs := sec.Key("AllowedIPs")
-	allowedHost := ipToIPNetWithHostMask(req.ip)
-	allowedIPs.SetValue((&allowedHost).String())
-
-	f, err := os.OpenFile(config, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	listenPort := ctx.Int("listen-port")
+
+	privateKey, err := lib.InitServer(lib.ServerInitOptions{
+		InterfaceName: inter,
+		ConfigPath:    ctx.String("config"),
+		Address:       net.IPNet{IP: subnetIP, Mask: subnet.Mask},
+		ListenPort:    listenPort,
+		Networkd:      ctx.Bool("networkd"),
+	})
 	if err != nil {
-		return fmt.Errorf("opening %s failed: %w", config, err)
+		return err
+	}
+
+	host := ctx.String("endpoint")
+	if host == "" {
+		host = "<public-address>"
 	}
-	_, err = cfg.WriteTo(f)
+	_, port, err := net.SplitHostPort(ctx.String("listen"))
 	if err != nil {
-		return fmt.Errorf("writing to %s failed: %w", config, err)
+		return fmt.Errorf("listen address %v not valid: %w", ctx.String("listen"), err)
 	}
+	endpoint := net.JoinHostPort(host, strconv.Itoa(listenPort))
+	fmt.Printf("Created interface %v with address %v\n", inter, ctx.String("subnet"))
+	fmt.Printf("Public key: %v\n", privateKey.PublicKey())
+	fmt.Printf("Endpoint: %v\n", endpoint)
+	fmt.Println()
+	fmt.Println("Start the server with:")
+	fmt.Printf("  wireguard-negotiator server --interface %v --endpoint %v --listen %v\n", inter, endpoint, ctx.String("listen"))
+	fmt.Println("Then enroll clients with:")
+	fmt.Printf("  wireguard-negotiator request --server http://%v\n", net.JoinHostPort(host, port))
 	return nil
 }
 
-func configReadInterfacePublicKey(config string) (string, error) {
-	cfg, err := ini.Load(config)
+// firstAddress returns the first address after the network address
+func firstAddress(network net.IPNet) string {
+	ip := make(net.IP, len(network.IP))
+	copy(ip, network.IP)
+	ip[len(ip)-1]++
+	return (&net.IPNet{IP: ip, Mask: network.Mask}).String()
+}
+
+// startUserspaceServer creates the interface and applies the configuration
+// file, equivalent to wg setconf
+func startUserspaceServer(inter string, config string, addresses []string) (*lib.UserspaceDevice, error) {
+	f, err := os.Open(config)
 	if err != nil {
-		return "", fmt.Errorf("read interface public key failed: %w", err)
+		return nil, fmt.Errorf("opening %s failed: %w", config, err)
 	}
-
-	b64PrivateKey := cfg.Section("Interface").Key("PrivateKey").String()
-	wgPrivateKey, err := wgtypes.ParseKey(b64PrivateKey)
+	defer f.Close()
+	wgConfig, _, err := lib.ReadConfig(f)
 	if err != nil {
-		return "", fmt.Errorf("read interface public key failed: %w", err)
+		return nil, err
 	}
-	wgPublicKey := wgPrivateKey.PublicKey()
-	return wgPublicKey.String(), nil
-}
 
-func interAddPeer(inter string, req request, config string) error {
-	// For every request, dynamically add the peer to the interface
-
-	// For now, simply run one fixed command to reread from the config file
-	cmd := exec.Command("wg", "setconf", inter, config)
-	err := cmd.Run()
+	dev, err := lib.StartUserspaceDevice(inter, 0)
 	if err != nil {
-		return fmt.Errorf("wq setconf failed: %w", err)
+		return nil, err
 	}
-	return nil
-}
 
-func ipToIPNetWithHostMask(ip net.IP) net.IPNet {
-	if ip4 := ip.To4(); ip4 != nil {
-		return net.IPNet{
-			IP:   ip,
-			Mask: net.CIDRMask(32, 32),
-		}
+	err = lib.WgctrlConfigurer{}.ConfigureDevice(inter, wgConfig)
+	if err != nil {
+		dev.Close()
+		return nil, err
 	}
-	return net.IPNet{
-		IP:   ip,
-		Mask: net.CIDRMask(128, 128),
+	commands := [][]string{
+		{"ip", "link", "set", inter, "up"},
 	}
-}
-
-func incrementIP(ip net.IP, inc int) net.IP {
-	result := make(net.IP, len(ip))
-	copy(result, ip)
-
-	for i := len(ip) - 1; i >= 0; i-- {
-		remainder := inc % 256
-		overflow := int(result[i])+remainder > 255
-
-		result[i] += byte(remainder)
-		if overflow {
-			inc += 256
+	for _, address := range addresses {
+		commands = append(commands, []string{"ip", "address", "add", address, "dev", inter})
+	}
+	for _, command := range commands {
+		cmd := exec.Command(command[0], command[1:]...)
+		err := cmd.Run()
+		if err != nil {
+			dev.Close()
+			return nil, fmt.Errorf("%s failed: %w", strings.Join(command, " "), err)
 		}
-		inc /= 256
 	}
-	return result
+	return dev, nil
 }
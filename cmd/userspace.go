@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"github.com/serverwentdown/wireguard-negotiator/lib"
+	"github.com/urfave/cli/v2"
+)
+
+var CmdUserspace = &cli.Command{
+	Name:  "userspace",
+	Usage: "Run a userspace WireGuard interface set up with request --type userspace, for hosts without the kernel module",
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:    "interface",
+			Aliases: []string{"i"},
+			Value:   "wg0",
+			Usage:   "Read default state path for the interface",
+		},
+		&cli.StringFlag{
+			Name:        "state",
+			Value:       "",
+			DefaultText: "/var/lib/wireguard-negotiator/<interface>.json",
+			Usage:       "Path to the state file saved by request",
+		},
+		&cli.StringFlag{
+			Name:        "pidfile",
+			Value:       "",
+			DefaultText: "/run/wireguard-negotiator/<interface>.pid",
+			Usage:       "Path to save the process ID of the daemon",
+		},
+		&cli.BoolFlag{
+			Name:    "foreground",
+			Aliases: []string{"f"},
+			Usage:   "Stay in the foreground instead of daemonizing",
+		},
+	},
+	Action: runUserspaceCommand,
+}
+
+func runUserspaceCommand(ctx *cli.Context) error {
+	inter := ctx.String("interface")
+	statePath := ctx.String("state")
+	if !ctx.IsSet("state") {
+		statePath = lib.DefaultStatePath(inter)
+	}
+	pidfile := ctx.String("pidfile")
+	if !ctx.IsSet("pidfile") {
+		pidfile = lib.DefaultPidfilePath(inter)
+	}
+
+	return lib.RunUserspace(statePath, pidfile, ctx.Bool("foreground"))
+}
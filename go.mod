@@ -5,6 +5,8 @@ go 1.13
 require (
 	github.com/google/go-cmp v0.3.1
 	github.com/urfave/cli/v2 v2.0.0
+	golang.org/x/crypto v0.0.0-20191206172530-e9b2fee46413
+	golang.zx2c4.com/wireguard v0.0.20191012
 	golang.zx2c4.com/wireguard/wgctrl v0.0.0-20191219145116-fa6499c8e75f
 	gopkg.in/ini.v1 v1.51.0
 )
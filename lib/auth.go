@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Requests from enrolled peers are authenticated with a HMAC keyed by the
+// Curve25519 shared secret of the peer key and the server key. This proves
+// possession of the private key without sending it
+const (
+	HeaderPublicKey = "WGN-Public-Key"
+	HeaderTimestamp = "WGN-Timestamp"
+	HeaderSignature = "WGN-Signature"
+)
+
+// MaxSignatureSkew is the maximum age of a signed request
+const MaxSignatureSkew = 5 * time.Minute
+
+var (
+	ErrUnauthenticated = fmt.Errorf("request is not signed")
+	ErrSignature       = fmt.Errorf("request signature not valid")
+	ErrSignatureSkew   = fmt.Errorf("request signature expired")
+	ErrBodyTooLarge    = fmt.Errorf("request body too large")
+)
+
+// SignRequest signs a request with the private key of the peer. The body must
+// be the same as the request body
+func SignRequest(r *http.Request, body []byte, privateKey wgtypes.Key, serverPublicKey wgtypes.Key) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac, err := requestMAC(r, body, timestamp, privateKey, serverPublicKey)
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set(HeaderPublicKey, privateKey.PublicKey().String())
+	r.Header.Set(HeaderTimestamp, timestamp)
+	r.Header.Set(HeaderSignature, base64.StdEncoding.EncodeToString(mac))
+	return nil
+}
+
+// VerifyRequest verifies a signed request with the private key of the server,
+// returning the public key of the peer. The request body is read, up to
+// maxBodySize, and replaced so that it can be read again
+func VerifyRequest(w http.ResponseWriter, r *http.Request, serverPrivateKey wgtypes.Key) (wgtypes.Key, error) {
+	b64PublicKey := r.Header.Get(HeaderPublicKey)
+	timestamp := r.Header.Get(HeaderTimestamp)
+	b64Signature := r.Header.Get(HeaderSignature)
+	if len(b64PublicKey) == 0 || len(timestamp) == 0 || len(b64Signature) == 0 {
+		return wgtypes.Key{}, ErrUnauthenticated
+	}
+
+	publicKey, err := wgtypes.ParseKey(b64PublicKey)
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("%w: %v", ErrSignature, err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(b64Signature)
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("%w: %v", ErrSignature, err)
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("%w: %v", ErrSignature, err)
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > MaxSignatureSkew || skew < -MaxSignatureSkew {
+		return wgtypes.Key{}, ErrSignatureSkew
+	}
+
+	var body []byte
+	if r.Body != nil {
+		body, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		if err != nil && len(body) >= maxBodySize {
+			return wgtypes.Key{}, fmt.Errorf("%w: %v", ErrBodyTooLarge, err)
+		}
+		if err != nil {
+			return wgtypes.Key{}, err
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+
+	mac, err := requestMAC(r, body, timestamp, serverPrivateKey, publicKey)
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+	if !hmac.Equal(mac, signature) {
+		return wgtypes.Key{}, ErrSignature
+	}
+	return publicKey, nil
+}
+
+func requestMAC(r *http.Request, body []byte, timestamp string, privateKey wgtypes.Key, publicKey wgtypes.Key) ([]byte, error) {
+	secret, err := curve25519.X25519(privateKey[:], publicKey[:])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSignature, err)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n", r.Method, r.URL.RequestURI(), timestamp)
+	mac.Write(body)
+	return mac.Sum(nil), nil
+}
@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestSignRequest(t *testing.T) {
+	serverPrivateKey, _ := wgtypes.GeneratePrivateKey()
+	peerPrivateKey, _ := wgtypes.GeneratePrivateKey()
+	body := []byte("PublicKey=test")
+
+	r, _ := http.NewRequest("POST", "http://example.com/sync?Version=1", bytes.NewReader(body))
+	err := SignRequest(r, body, peerPrivateKey, serverPrivateKey.PublicKey())
+	if err != nil {
+		t.Fatalf("sign failed: %v", err)
+	}
+
+	received := httptest.NewRequest("POST", "/sync?Version=1", bytes.NewReader(body))
+	received.Header = r.Header
+	got, err := VerifyRequest(httptest.NewRecorder(), received, serverPrivateKey)
+	if err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if want := peerPrivateKey.PublicKey(); got != want {
+		t.Fatalf("verified public key %v, want %v", got, want)
+	}
+
+	tampered := httptest.NewRequest("POST", "/sync?Version=2", bytes.NewReader(body))
+	tampered.Header = r.Header
+	_, err = VerifyRequest(httptest.NewRecorder(), tampered, serverPrivateKey)
+	if !errors.Is(err, ErrSignature) {
+		t.Fatalf("verify error %v, want %v", err, ErrSignature)
+	}
+
+	unsigned := httptest.NewRequest("POST", "/sync?Version=1", bytes.NewReader(body))
+	_, err = VerifyRequest(httptest.NewRecorder(), unsigned, serverPrivateKey)
+	if !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("verify error %v, want %v", err, ErrUnauthenticated)
+	}
+
+	large := make([]byte, maxBodySize+1)
+	r, _ = http.NewRequest("POST", "http://example.com/rotate", bytes.NewReader(large))
+	err = SignRequest(r, large, peerPrivateKey, serverPrivateKey.PublicKey())
+	if err != nil {
+		t.Fatalf("sign failed: %v", err)
+	}
+	oversized := httptest.NewRequest("POST", "/rotate", bytes.NewReader(large))
+	oversized.Header = r.Header
+	_, err = VerifyRequest(httptest.NewRecorder(), oversized, serverPrivateKey)
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatalf("verify error %v, want %v", err, ErrBodyTooLarge)
+	}
+}
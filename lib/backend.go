@@ -0,0 +1,666 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var ErrTypeNotValid = fmt.Errorf("network interface backend type not valid")
+var ErrInterfaceNotUp = fmt.Errorf("interface did not come up")
+var ErrPermissiveMode = fmt.Errorf("refusing to write a key into a file readable by others")
+
+// DefaultVerifyTimeout is how long Apply waits for the interface to come up
+const DefaultVerifyTimeout = 30 * time.Second
+
+// Backend sets up a local WireGuard interface from peer configuration. The
+// request command calls Prepare before making the request, then Write and
+// Apply, and Rollback if any step fails. The agent calls Write and Apply on
+// every change
+type Backend interface {
+	// Prepare checks that the interface is not already configured
+	Prepare() error
+	// Write renders and writes the configuration
+	Write(config InterfaceAndPeerConfig) error
+	// Apply brings the interface up with the written configuration, or updates
+	// the existing interface
+	Apply() error
+	// Rollback restores the configuration and interface as they were before
+	// Write
+	Rollback() error
+	// Remove removes the configuration and the interface
+	Remove() error
+}
+
+// BackendOptions are given to every backend. Empty paths use the default
+// paths of the backend
+type BackendOptions struct {
+	InterfaceName string
+	// Path to the backend configuration. For networkd, this is without
+	// extensions. For userspace, this is the pidfile
+	ConfigPath string
+	// Path to the WireGuard configuration file, for backends that write one
+	WireGuardConfigPath string
+	// Path to the state file, for backends that start from the state
+	StatePath string
+	// Foreground keeps backends that run a process in the foreground
+	Foreground bool
+	// Directory of template files that replace built-in templates, or that
+	// are rendered by the template backend
+	TemplateDir string
+	// Shell command run by the template backend to apply written files
+	TemplateCommand string
+	// How long Apply waits for the interface to come up with its addresses.
+	// Zero uses DefaultVerifyTimeout, and a negative value skips the check
+	VerifyTimeout time.Duration
+
+	Runner Runner
+	Device DeviceConfigurer
+}
+
+// BackendFactory creates a backend
+type BackendFactory func(options BackendOptions) Backend
+
+var (
+	backendsLock sync.Mutex
+	backends     = make(map[string]BackendFactory)
+)
+
+// RegisterBackend makes a backend available by name. Programs that embed the
+// negotiator can register their own backends
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	backends[name] = factory
+}
+
+// NewBackend creates a registered backend. A nil Runner or Device in the
+// options is replaced with one that acts on the system
+func NewBackend(name string, options BackendOptions) (Backend, error) {
+	backendsLock.Lock()
+	factory, ok := backends[name]
+	backendsLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrTypeNotValid, name)
+	}
+
+	if options.Runner == nil {
+		options.Runner = ExecRunner{}
+	}
+	if options.Device == nil {
+		options.Device = WgctrlConfigurer{}
+	}
+	return factory(options), nil
+}
+
+// Backends lists the names of registered backends
+func Backends() []string {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Runner runs system commands, returning standard output
+type Runner interface {
+	Run(stdin []byte, name string, args ...string) ([]byte, error)
+}
+
+// ExecRunner runs commands on the system
+type ExecRunner struct{}
+
+func (ExecRunner) Run(stdin []byte, name string, args ...string) ([]byte, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("%s %s failed: %w: %s", name, strings.Join(args, " "), err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// DeviceConfigurer configures WireGuard interfaces directly
+type DeviceConfigurer interface {
+	ConfigureDevice(name string, config wgtypes.Config) error
+}
+
+// WgctrlConfigurer configures WireGuard interfaces with wgctrl
+type WgctrlConfigurer struct{}
+
+func (WgctrlConfigurer) ConfigureDevice(name string, config wgtypes.Config) error {
+	client, err := wgctrl.New()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	err = client.ConfigureDevice(name, config)
+	if err != nil {
+		return fmt.Errorf("configure %s failed: %w", name, err)
+	}
+	return nil
+}
+
+// InterfaceAndPeerConfig is the configuration of the local interface rendered
+// by backends
+type InterfaceAndPeerConfig struct {
+	PeerConfigResponse
+	PrivateKey    string
+	InterfaceName string
+	ListenPort    int
+}
+
+// Routing table and firewall mark used for full-tunnel policy routing, the
+// same defaults as wg-quick
+const (
+	FullTunnelTable = 51820
+	FullTunnelMark  = 0xca6c
+)
+
+// FullTunnel reports whether any pushed route is a default route
+func (c InterfaceAndPeerConfig) FullTunnel() bool {
+	for _, route := range c.Routes {
+		if isDefaultRoute(route) {
+			return true
+		}
+	}
+	return false
+}
+
+// PeersConfig converts the server peer and mesh peers into a configuration
+// that replaces existing peers
+func (c InterfaceAndPeerConfig) PeersConfig() (wgtypes.Config, error) {
+	peers := []PeerConfig{
+		{
+			PublicKey:           c.PublicKey,
+			Endpoint:            c.Endpoint,
+			AllowedIPs:          c.AllowedIPs,
+			PersistentKeepalive: c.PersistentKeepalive,
+		},
+	}
+	peers = append(peers, c.Peers...)
+
+	wgConfig := wgtypes.Config{ReplacePeers: true}
+	for _, peer := range peers {
+		peerConfig, err := peer.WireGuardConfig()
+		if err != nil {
+			return wgConfig, err
+		}
+		wgConfig.Peers = append(wgConfig.Peers, peerConfig)
+	}
+	// Only the server peer has a preshared key
+	if len(c.PresharedKey) > 0 {
+		presharedKey, err := wgtypes.ParseKey(c.PresharedKey)
+		if err != nil {
+			return wgConfig, fmt.Errorf("preshared key not valid: %w", err)
+		}
+		wgConfig.Peers[0].PresharedKey = &presharedKey
+	}
+	return wgConfig, nil
+}
+
+// DeviceConfig converts the whole config, including the private key
+func (c InterfaceAndPeerConfig) DeviceConfig() (wgtypes.Config, error) {
+	privateKey, err := wgtypes.ParseKey(c.PrivateKey)
+	if err != nil {
+		return wgtypes.Config{}, fmt.Errorf("private key not valid: %w", err)
+	}
+
+	wgConfig, err := c.PeersConfig()
+	if err != nil {
+		return wgConfig, err
+	}
+	wgConfig.PrivateKey = &privateKey
+	if c.ListenPort > 0 {
+		listenPort := c.ListenPort
+		wgConfig.ListenPort = &listenPort
+	}
+	if c.FullTunnel() {
+		firewallMark := FullTunnelMark
+		wgConfig.FirewallMark = &firewallMark
+	}
+	return wgConfig, nil
+}
+
+// secrets returns the keys that must not be written into files readable by
+// others
+func (c InterfaceAndPeerConfig) secrets() [][]byte {
+	var secrets [][]byte
+	for _, secret := range []string{c.PrivateKey, c.PresharedKey} {
+		if len(secret) > 0 {
+			secrets = append(secrets, []byte(secret))
+		}
+	}
+	return secrets
+}
+
+// WireGuardConfig converts the peer for wgctrl
+func (p PeerConfig) WireGuardConfig() (wgtypes.PeerConfig, error) {
+	publicKey, err := wgtypes.ParseKey(p.PublicKey)
+	if err != nil {
+		return wgtypes.PeerConfig{}, fmt.Errorf("peer public key not valid: %w", err)
+	}
+	peerConfig := wgtypes.PeerConfig{
+		PublicKey:         publicKey,
+		ReplaceAllowedIPs: true,
+	}
+	if len(p.Endpoint) > 0 {
+		peerConfig.Endpoint, err = net.ResolveUDPAddr("udp", p.Endpoint)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("peer endpoint not valid: %w", err)
+		}
+	}
+	for _, allowedIP := range p.AllowedIPs {
+		_, ipNet, err := net.ParseCIDR(allowedIP)
+		if err != nil {
+			return wgtypes.PeerConfig{}, fmt.Errorf("peer allowed IP not valid: %w", err)
+		}
+		peerConfig.AllowedIPs = append(peerConfig.AllowedIPs, *ipNet)
+	}
+	persistentKeepalive := time.Duration(p.PersistentKeepalive) * time.Second
+	peerConfig.PersistentKeepaliveInterval = &persistentKeepalive
+	return peerConfig, nil
+}
+
+func isDefaultRoute(route string) bool {
+	return strings.HasSuffix(route, "/0")
+}
+
+// filterAddresses returns addresses or prefixes of one address family
+func filterAddresses(addresses []string, v6 bool) []string {
+	var filtered []string
+	for _, address := range addresses {
+		if strings.Contains(address, ":") == v6 {
+			filtered = append(filtered, address)
+		}
+	}
+	return filtered
+}
+
+// WithoutDefaultRoutes filters out default routes, which full-tunnel
+// configuration installs separately
+func WithoutDefaultRoutes(routes []string) []string {
+	var filtered []string
+	for _, route := range routes {
+		if !isDefaultRoute(route) {
+			filtered = append(filtered, route)
+		}
+	}
+	return filtered
+}
+
+// TemplateFuncs are available in every backend template
+var TemplateFuncs = template.FuncMap{
+	"join":                 strings.Join,
+	"quote":                strconv.Quote,
+	"add1":                 func(i int) int { return i + 1 },
+	"ipv4":                 func(a []string) []string { return filterAddresses(a, false) },
+	"ipv6":                 func(a []string) []string { return filterAddresses(a, true) },
+	"isDefaultRoute":       isDefaultRoute,
+	"withoutDefaultRoutes": WithoutDefaultRoutes,
+	"fullTunnelTable":      func() int { return FullTunnelTable },
+	"fullTunnelMark":       func() int { return FullTunnelMark },
+	"families":             func() []string { return []string{"-4", "-6"} },
+	"defaultRoutes":        func() []string { return []string{"0.0.0.0/0", "::/0"} },
+	"endpointHost": func(endpoint string) string {
+		host, _, _ := net.SplitHostPort(endpoint)
+		return host
+	},
+	"endpointPort": func(endpoint string) string {
+		_, port, _ := net.SplitHostPort(endpoint)
+		return port
+	},
+	"uciQuote": func(s string) string {
+		return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+	},
+}
+
+// TemplateExt is the extension of template files in a template directory
+const TemplateExt = ".tmpl"
+
+// renderTemplate renders a built-in template, or the template file of the same
+// name in templateDir if there is one
+func renderTemplate(templateDir string, name string, text string, data interface{}) ([]byte, error) {
+	if templateDir != "" {
+		path := filepath.Join(templateDir, name+TemplateExt)
+		b, err := ioutil.ReadFile(path)
+		if err == nil {
+			text = string(b)
+		} else if !os.IsNotExist(err) {
+			return nil, fmt.Errorf("reading %s failed: %w", path, err)
+		}
+	}
+
+	// For ease of maintenance, just render a textual template
+	t, err := template.New(name).Funcs(TemplateFuncs).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%s template: %w", name, err)
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s template: %w", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// checkNotExist ensures that a backend does not overwrite existing files when
+// setting up a new interface
+func checkNotExist(paths ...string) error {
+	for _, path := range paths {
+		_, err := os.Stat(path)
+		if err == nil {
+			return fmt.Errorf("opening %s failed: %w", path, os.ErrExist)
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("opening %s failed: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// interfaceExists reports whether a network interface exists
+func interfaceExists(name string) bool {
+	_, err := net.InterfaceByName(name)
+	return err == nil
+}
+
+// waitInterface waits until the interface is up with all of the addresses,
+// as network managers may bring up interfaces after their commands return
+func waitInterface(name string, addresses []string, timeout time.Duration) error {
+	if timeout < 0 {
+		return nil
+	}
+	if timeout == 0 {
+		timeout = DefaultVerifyTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err := checkInterface(name, addresses)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%w: %s: %v", ErrInterfaceNotUp, name, err)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func checkInterface(name string, addresses []string) error {
+	inter, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	if inter.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("interface is down")
+	}
+	addrs, err := inter.Addrs()
+	if err != nil {
+		return err
+	}
+	for _, address := range addresses {
+		ip, _, err := net.ParseCIDR(address)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("address %s not assigned", address)
+		}
+	}
+	return nil
+}
+
+// verify waits for the interface of a backend to come up
+func (o BackendOptions) verify(config InterfaceAndPeerConfig) error {
+	return waitInterface(o.InterfaceName, config.InterfaceIPs, o.VerifyTimeout)
+}
+
+// fileSet writes backend files, remembering their previous contents so that
+// they can be rolled back. Files are staged and then moved into place
+// together, so that a failure while writing does not leave partial files
+type fileSet struct {
+	// Keys that may only be written into files without permissions for
+	// others, and at most read permission for the group
+	secrets [][]byte
+	staged  []stagedFile
+	// A nil value means the file did not exist
+	previous map[string]*stagedFile
+	order    []string
+}
+
+type stagedFile struct {
+	path    string
+	content []byte
+	perm    os.FileMode
+	// Owning group, or -1 to leave the group of new files unchanged
+	gid int
+}
+
+// stage adds a file to be written by commit
+func (f *fileSet) stage(path string, content []byte, perm os.FileMode) {
+	f.staged = append(f.staged, stagedFile{path, content, perm, -1})
+}
+
+// stageGroup adds a file owned by the group to be written by commit. If the
+// group does not exist, the group permissions are removed instead
+func (f *fileSet) stageGroup(path string, content []byte, perm os.FileMode, group string) {
+	gid := -1
+	if g, err := user.LookupGroup(group); err == nil {
+		gid, err = strconv.Atoi(g.Gid)
+		if err != nil {
+			gid = -1
+		}
+	}
+	if gid < 0 {
+		perm &^= 0070
+	}
+	f.staged = append(f.staged, stagedFile{path, content, perm, gid})
+}
+
+// checkSecrets ensures that staged files containing keys are not readable by
+// others
+func (f *fileSet) checkSecrets() error {
+	for _, file := range f.staged {
+		if file.perm&0037 == 0 {
+			continue
+		}
+		for _, secret := range f.secrets {
+			if bytes.Contains(file.content, secret) {
+				return fmt.Errorf("%w: %s with mode %v", ErrPermissiveMode, file.path, file.perm)
+			}
+		}
+	}
+	return nil
+}
+
+// commit writes staged files that differ from existing files to temporary
+// files, then moves them into place, reporting whether any file changed
+func (f *fileSet) commit() (bool, error) {
+	err := f.checkSecrets()
+	if err != nil {
+		f.staged = nil
+		return false, err
+	}
+	staged := f.staged
+	f.staged = nil
+
+	// Temporary files to rename over each path
+	temps := make(map[string]string)
+	var paths []string
+	defer func() {
+		for _, temp := range temps {
+			os.Remove(temp)
+		}
+	}()
+	for _, file := range staged {
+		existing, err := ioutil.ReadFile(file.path)
+		if err != nil && !os.IsNotExist(err) {
+			return false, fmt.Errorf("reading %s failed: %w", file.path, err)
+		}
+		// Files with the wrong permissions are rewritten too
+		if err == nil && bytes.Equal(existing, file.content) && fileOwnedWith(file.path, file.perm, file.gid) {
+			continue
+		}
+		temp, err := writeTemp(file.path, file.content, file.perm, file.gid)
+		if err != nil {
+			return false, err
+		}
+		temps[file.path] = temp
+		paths = append(paths, file.path)
+
+		if f.previous == nil {
+			f.previous = make(map[string]*stagedFile)
+		}
+		if _, ok := f.previous[file.path]; !ok {
+			f.order = append(f.order, file.path)
+			f.previous[file.path] = nil
+			if info, err := os.Stat(file.path); err == nil {
+				f.previous[file.path] = &stagedFile{file.path, existing, info.Mode().Perm(), fileGroup(info)}
+			}
+		}
+	}
+
+	for _, path := range paths {
+		err := os.Rename(temps[path], path)
+		if err != nil {
+			return false, fmt.Errorf("writing %s failed: %w", path, err)
+		}
+		delete(temps, path)
+	}
+	return len(paths) > 0, nil
+}
+
+// created reports whether a written file did not exist before
+func (f *fileSet) created(path string) bool {
+	previous, ok := f.previous[path]
+	return ok && previous == nil
+}
+
+// rollback restores every written file
+func (f *fileSet) rollback() error {
+	for i := len(f.order) - 1; i >= 0; i-- {
+		path := f.order[i]
+		previous := f.previous[path]
+		if previous == nil {
+			err := os.Remove(path)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("restoring %s failed: %w", path, err)
+			}
+			continue
+		}
+		temp, err := writeTemp(path, previous.content, previous.perm, previous.gid)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(temp, path)
+		if err != nil {
+			os.Remove(temp)
+			return fmt.Errorf("restoring %s failed: %w", path, err)
+		}
+	}
+	f.previous = nil
+	f.order = nil
+	return nil
+}
+
+// writeTemp writes a temporary file next to path, so that it can be renamed
+// over path. The file is only readable by the owner until it is complete
+func writeTemp(path string, content []byte, perm os.FileMode, gid int) (string, error) {
+	file, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return "", fmt.Errorf("writing %s failed: %w", path, err)
+	}
+	_, err = file.Write(content)
+	if err == nil && gid >= 0 {
+		err = file.Chown(-1, gid)
+	}
+	if err == nil {
+		err = file.Chmod(perm)
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("writing %s failed: %w", path, err)
+	}
+	return file.Name(), nil
+}
+
+// restrictFile removes permissions for the group and others from an existing
+// file, before a key is written into it. It refuses with ErrPermissiveMode if
+// the file is still readable by others
+func restrictFile(path string) error {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s failed: %w", path, err)
+	}
+	if info.Mode().Perm()&0077 == 0 {
+		return nil
+	}
+	err = os.Chmod(path, info.Mode().Perm()&^0077)
+	if err != nil {
+		return fmt.Errorf("%w: %s with mode %v: %v", ErrPermissiveMode, path, info.Mode().Perm(), err)
+	}
+	info, err = os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("reading %s failed: %w", path, err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("%w: %s with mode %v", ErrPermissiveMode, path, info.Mode().Perm())
+	}
+	return nil
+}
+
+// fileOwnedWith reports whether the file has the permissions and group
+func fileOwnedWith(path string, perm os.FileMode, gid int) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return info.Mode().Perm() == perm && (gid < 0 || fileGroup(info) == gid)
+}
+
+// removeFiles removes files, ignoring those that do not exist
+func removeFiles(paths ...string) error {
+	for _, path := range paths {
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("removing %s failed: %w", path, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1038 @@
+package lib
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// fakeRunner records commands instead of running them
+type fakeRunner struct {
+	commands []string
+	// Standard input of each command
+	stdins [][]byte
+	// Output and errors of commands, by command line
+	outputs map[string][]byte
+	errors  map[string]error
+}
+
+func (r *fakeRunner) Run(stdin []byte, name string, args ...string) ([]byte, error) {
+	command := strings.Join(append([]string{name}, args...), " ")
+	r.commands = append(r.commands, command)
+	r.stdins = append(r.stdins, stdin)
+	return r.outputs[command], r.errors[command]
+}
+
+type fakeDevice struct {
+	configs []wgtypes.Config
+}
+
+func (d *fakeDevice) ConfigureDevice(name string, config wgtypes.Config) error {
+	d.configs = append(d.configs, config)
+	return nil
+}
+
+func testConfig() InterfaceAndPeerConfig {
+	return InterfaceAndPeerConfig{
+		PeerConfigResponse: PeerConfigResponse{
+			InterfaceIPs:        []string{"10.0.0.2/32"},
+			AllowedIPs:          []string{"10.0.0.0/24"},
+			PublicKey:           "GtL7fZc/bLnqZldpVofMCD6hDjrK28SsdLxevJ+qtKU=",
+			Endpoint:            "192.0.2.1:51820",
+			PersistentKeepalive: 25,
+		},
+		PrivateKey:    "QFqZ3SI7Q+iTzFCQRIbv0jf5Y0fNjLhNAvGLaP5dSHk=",
+		InterfaceName: "wgntest0",
+	}
+}
+
+func TestNewBackend(t *testing.T) {
+	_, err := NewBackend("unknown", BackendOptions{})
+	if !errors.Is(err, ErrTypeNotValid) {
+		t.Fatalf("got error %v, want %v", err, ErrTypeNotValid)
+	}
+
+	names := Backends()
+	for _, name := range []string{"ifupdown", "netplan", "networkd", "networkmanager", "template", "uci", "userspace"} {
+		found := false
+		for _, registered := range names {
+			found = found || registered == name
+		}
+		if !found {
+			t.Errorf("backend %v not registered", name)
+		}
+	}
+}
+
+func TestRenderPushedConfig(t *testing.T) {
+	split := testConfig()
+	split.AllowedIPs = []string{"10.0.0.0/24", "192.168.0.0/16"}
+	split.Routes = []string{"192.168.0.0/16"}
+	split.DNS = []string{"10.0.0.1"}
+	split.DNSSearch = []string{"internal.example.com"}
+	split.MTU = 1380
+	full := testConfig()
+	full.AllowedIPs = []string{"10.0.0.0/24", "0.0.0.0/0", "::/0"}
+	full.Routes = []string{"0.0.0.0/0", "::/0"}
+
+	netdev := func(config InterfaceAndPeerConfig) ([]byte, error) {
+		netdev, _, err := renderNetworkd("", networkdConfig{InterfaceAndPeerConfig: config})
+		return netdev, err
+	}
+	network := func(config InterfaceAndPeerConfig) ([]byte, error) {
+		_, network, err := renderNetworkd("", networkdConfig{InterfaceAndPeerConfig: config})
+		return network, err
+	}
+	builtin := func(name string, text string) func(InterfaceAndPeerConfig) ([]byte, error) {
+		return func(config InterfaceAndPeerConfig) ([]byte, error) {
+			return renderTemplate("", name, text, config)
+		}
+	}
+	ifupdown := func(config InterfaceAndPeerConfig) ([]byte, error) {
+		return renderTemplate("", "ifupdown", ifupdownTemplate, ifupdownConfig{config, "/etc/wireguard/wgntest0.conf"})
+	}
+
+	tests := []struct {
+		name    string
+		render  func(InterfaceAndPeerConfig) ([]byte, error)
+		config  InterfaceAndPeerConfig
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "networkd netdev split",
+			render:  netdev,
+			config:  split,
+			want:    []string{"AllowedIPs = 10.0.0.0/24, 192.168.0.0/16\n"},
+			notWant: []string{"FirewallMark"},
+		},
+		{
+			name:   "networkd network split",
+			render: network,
+			config: split,
+			want: []string{
+				"[Link]\nMTUBytes = 1380\n",
+				"DNS = 10.0.0.1\n",
+				"Domains = internal.example.com\n",
+				"[Route]\nDestination = 192.168.0.0/16\n",
+			},
+			notWant: []string{"Table", "[RoutingPolicyRule]"},
+		},
+		{
+			name:   "networkd netdev full tunnel",
+			render: netdev,
+			config: full,
+			want: []string{
+				"FirewallMark = 51820\n",
+				"AllowedIPs = 10.0.0.0/24, 0.0.0.0/0, ::/0\n",
+			},
+		},
+		{
+			name:   "networkd network full tunnel",
+			render: network,
+			config: full,
+			want: []string{
+				"[Route]\nDestination = 0.0.0.0/0\n\nTable = 51820\n",
+				"[Route]\nDestination = ::/0\n\nTable = 51820\n",
+				"FirewallMark = 51820\nInvertRule = yes\nTable = 51820\n",
+				"SuppressPrefixLength = 0\n",
+			},
+			notWant: []string{"[Link]", "DNS =", "Domains ="},
+		},
+		{
+			name:   "networkmanager split",
+			render: builtin("networkmanager", networkManagerTemplate),
+			config: split,
+			want: []string{
+				"mtu=1380\n",
+				"allowed-ips=10.0.0.0/24;192.168.0.0/16;\n",
+				"dns=10.0.0.1;\n",
+				"dns-search=internal.example.com;\n",
+				"route1=192.168.0.0/16\n",
+			},
+			notWant: []string{"fwmark", "auto-default-route"},
+		},
+		{
+			name:   "networkmanager full tunnel",
+			render: builtin("networkmanager", networkManagerTemplate),
+			config: full,
+			want: []string{
+				"fwmark=51820\nip4-auto-default-route=1\nip6-auto-default-route=1\n",
+				"allowed-ips=10.0.0.0/24;0.0.0.0/0;::/0;\n",
+			},
+			notWant: []string{"route1=", "mtu="},
+		},
+		{
+			name:   "netplan split",
+			render: builtin("netplan", netplanTemplate),
+			config: split,
+			want: []string{
+				"      mtu: 1380\n",
+				"        addresses:\n          - \"10.0.0.1\"\n",
+				"        search:\n          - \"internal.example.com\"\n",
+				"      routes:\n        - to: \"192.168.0.0/16\"\n          scope: link\n",
+			},
+			notWant: []string{"mark:", "table:", "routing-policy:"},
+		},
+		{
+			name:   "netplan full tunnel",
+			render: builtin("netplan", netplanTemplate),
+			config: full,
+			want: []string{
+				"      mark: 51820\n",
+				"        - to: \"0.0.0.0/0\"\n          scope: link\n          table: 51820\n",
+				"        - to: \"::/0\"\n          mark: 51820\n          table: 254\n",
+				"            - \"0.0.0.0/0\"\n            - \"::/0\"\n",
+			},
+			notWant: []string{"nameservers:", "mtu:"},
+		},
+		{
+			name:   "ifupdown split",
+			render: ifupdown,
+			config: split,
+			want: []string{
+				"\tpre-up ip link set $IFACE mtu 1380\n",
+				"\tup ip route add 192.168.0.0/16 dev $IFACE\n",
+				"\tdns-nameservers 10.0.0.1\n",
+				"\tdns-search internal.example.com\n",
+			},
+			notWant: []string{"fwmark", "table"},
+		},
+		{
+			name:   "ifupdown full tunnel",
+			render: ifupdown,
+			config: full,
+			want: []string{
+				"\tup ip -4 route add default dev $IFACE table 51820\n",
+				"\tup ip -6 rule add not fwmark 51820 table 51820\n",
+				"\tdown ip -6 rule del table main suppress_prefixlength 0\n",
+			},
+			notWant: []string{"route add 0.0.0.0/0", "route add ::/0", "mtu"},
+		},
+		{
+			name:    "wg setconf full tunnel",
+			render:  builtin("wireguard", wireguardTemplate),
+			config:  full,
+			want:    []string{"FwMark = 51820\n", "AllowedIPs = 10.0.0.0/24, 0.0.0.0/0, ::/0\n"},
+			notWant: []string{"DNS"},
+		},
+		{
+			name:   "uci split",
+			render: builtin("uci", uciTemplate),
+			config: split,
+			want: []string{
+				"set network.wgntest0.mtu='1380'\n",
+				"add_list network.wgntest0.dns='10.0.0.1'\n",
+				"add_list network.wgntest0.dns_search='internal.example.com'\n",
+				"add_list network.wireguard_wgntest0_server.allowed_ips='192.168.0.0/16'\n",
+			},
+		},
+		{
+			name:   "uci full tunnel",
+			render: builtin("uci", uciTemplate),
+			config: full,
+			want: []string{
+				"add_list network.wireguard_wgntest0_server.allowed_ips='0.0.0.0/0'\n",
+				"add_list network.wireguard_wgntest0_server.allowed_ips='::/0'\n",
+			},
+			notWant: []string{".mtu=", ".dns="},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := test.render(test.config)
+			if err != nil {
+				t.Fatalf("render failed: %v", err)
+			}
+			for _, want := range test.want {
+				if !strings.Contains(string(got), want) {
+					t.Errorf("rendered output missing %q:\n%s", want, got)
+				}
+			}
+			for _, notWant := range test.notWant {
+				if strings.Contains(string(got), notWant) {
+					t.Errorf("rendered output contains %q:\n%s", notWant, got)
+				}
+			}
+		})
+	}
+}
+
+func TestNetworkdBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "wgntest0")
+
+	runner := &fakeRunner{}
+	backend, err := NewBackend("networkd", BackendOptions{
+		InterfaceName: "wgntest0",
+		ConfigPath:    configPath,
+		VerifyTimeout: -1,
+		Runner:        runner,
+		Device:        &fakeDevice{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = backend.Prepare()
+	if err != nil {
+		t.Fatalf("prepare failed: %v", err)
+	}
+	err = backend.Write(testConfig())
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	netdev, err := ioutil.ReadFile(configPath + ".netdev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(netdev), "PublicKey = GtL7fZc/bLnqZldpVofMCD6hDjrK28SsdLxevJ+qtKU=") {
+		t.Errorf("netdev missing peer:\n%s", netdev)
+	}
+	if strings.Contains(string(netdev), testConfig().PrivateKey) {
+		t.Errorf("netdev contains private key:\n%s", netdev)
+	}
+	if !strings.Contains(string(netdev), "PrivateKeyFile = "+configPath+".key") {
+		t.Errorf("netdev missing private key file:\n%s", netdev)
+	}
+	info, err := os.Stat(configPath + ".key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0037 != 0 {
+		t.Errorf("private key file has mode %v", info.Mode().Perm())
+	}
+	err = backend.Apply()
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if want := []string{"systemctl restart systemd-networkd"}; strings.Join(runner.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ran %v, want %v", runner.commands, want)
+	}
+
+	// Unchanged configuration is not applied again
+	runner.commands = nil
+	err = backend.Write(testConfig())
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	err = backend.Apply()
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if len(runner.commands) != 0 {
+		t.Errorf("ran %v, want nothing", runner.commands)
+	}
+
+	err = backend.Prepare()
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("got error %v, want %v", err, os.ErrExist)
+	}
+}
+
+func TestNetworkdBackendPresharedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "wgntest0")
+	config := testConfig()
+	config.PresharedKey = "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="
+
+	backend, err := NewBackend("networkd", BackendOptions{
+		InterfaceName: "wgntest0",
+		ConfigPath:    configPath,
+		VerifyTimeout: -1,
+		Runner:        &fakeRunner{},
+		Device:        &fakeDevice{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Write(config)
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	netdev, err := ioutil.ReadFile(configPath + ".netdev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(netdev), config.PresharedKey) {
+		t.Errorf("netdev contains preshared key:\n%s", netdev)
+	}
+	if !strings.Contains(string(netdev), "PresharedKeyFile = "+configPath+".psk") {
+		t.Errorf("netdev missing preshared key file:\n%s", netdev)
+	}
+	info, err := os.Stat(configPath + ".psk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0037 != 0 {
+		t.Errorf("preshared key file has mode %v", info.Mode().Perm())
+	}
+
+	// The preshared key is kept out of world-readable files too
+	templateDir := filepath.Join(dir, "templates")
+	err = os.Mkdir(templateDir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(templateDir, "netdev"+TemplateExt), []byte("[WireGuardPeer]\nPresharedKey = {{.PresharedKey}}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err = NewBackend("networkd", BackendOptions{
+		InterfaceName: "wgntest1",
+		ConfigPath:    filepath.Join(dir, "wgntest1"),
+		TemplateDir:   templateDir,
+		Runner:        &fakeRunner{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Write(config)
+	if !errors.Is(err, ErrPermissiveMode) {
+		t.Fatalf("got error %v, want %v", err, ErrPermissiveMode)
+	}
+}
+
+func TestNetworkdBackendRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "wgntest0")
+
+	existing := []byte("[NetDev]\n")
+	err = ioutil.WriteFile(configPath+".netdev", existing, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := NewBackend("networkd", BackendOptions{
+		InterfaceName: "wgntest0",
+		ConfigPath:    configPath,
+		Runner:        &fakeRunner{},
+		Device:        &fakeDevice{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Write(testConfig())
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	err = backend.Rollback()
+	if err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+
+	netdev, err := ioutil.ReadFile(configPath + ".netdev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(netdev) != string(existing) {
+		t.Errorf("netdev not restored:\n%s", netdev)
+	}
+	if _, err := os.Stat(configPath + ".network"); !os.IsNotExist(err) {
+		t.Errorf("network not removed: %v", err)
+	}
+}
+
+func TestNetworkdBackendNotUp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "wgntest0")
+
+	backend, err := NewBackend("networkd", BackendOptions{
+		InterfaceName: "wgntest0",
+		ConfigPath:    configPath,
+		VerifyTimeout: 100 * time.Millisecond,
+		Runner:        &fakeRunner{},
+		Device:        &fakeDevice{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Write(testConfig())
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	err = backend.Apply()
+	if !errors.Is(err, ErrInterfaceNotUp) {
+		t.Fatalf("got error %v, want %v", err, ErrInterfaceNotUp)
+	}
+	err = backend.Rollback()
+	if err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+
+	// Neither outputs nor staged temporary files are left behind
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("file %v left behind", entry.Name())
+	}
+	err = backend.Prepare()
+	if err != nil {
+		t.Errorf("prepare after rollback failed: %v", err)
+	}
+}
+
+func TestNetworkdBackendPermissive(t *testing.T) {
+	templateDir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(templateDir)
+	outputDir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	// An override that puts the key back into the world-readable netdev
+	err = ioutil.WriteFile(filepath.Join(templateDir, "netdev"+TemplateExt), []byte("[WireGuard]\nPrivateKey = {{.PrivateKey}}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := NewBackend("networkd", BackendOptions{
+		InterfaceName: "wgntest0",
+		ConfigPath:    filepath.Join(outputDir, "wgntest0"),
+		TemplateDir:   templateDir,
+		Runner:        &fakeRunner{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Write(testConfig())
+	if !errors.Is(err, ErrPermissiveMode) {
+		t.Fatalf("got error %v, want %v", err, ErrPermissiveMode)
+	}
+
+	entries, err := ioutil.ReadDir(outputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("file %v written", entry.Name())
+	}
+}
+
+func TestTemplateBackend(t *testing.T) {
+	templateDir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(templateDir)
+	outputDir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	err = ioutil.WriteFile(filepath.Join(templateDir, "{{.InterfaceName}}.conf.tmpl"), []byte("Address = {{join .InterfaceIPs \", \"}}\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runner := &fakeRunner{}
+	backend, err := NewBackend("template", BackendOptions{
+		InterfaceName:   "wgntest0",
+		ConfigPath:      outputDir,
+		TemplateDir:     templateDir,
+		TemplateCommand: "true",
+		Runner:          runner,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Prepare()
+	if err != nil {
+		t.Fatalf("prepare failed: %v", err)
+	}
+	err = backend.Write(testConfig())
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	err = backend.Apply()
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(outputDir, "wgntest0.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Address = 10.0.0.2/32\n"; string(got) != want {
+		t.Errorf("rendered %q, want %q", got, want)
+	}
+	if want := []string{"sh -c true"}; strings.Join(runner.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ran %v, want %v", runner.commands, want)
+	}
+}
+
+func TestTemplateOverride(t *testing.T) {
+	templateDir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(templateDir)
+	outputDir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(outputDir)
+
+	err = ioutil.WriteFile(filepath.Join(templateDir, "network"+TemplateExt), []byte("[Link]\nRequiredForOnline = no\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := NewBackend("networkd", BackendOptions{
+		InterfaceName: "wgntest0",
+		ConfigPath:    filepath.Join(outputDir, "wgntest0"),
+		TemplateDir:   templateDir,
+		Runner:        &fakeRunner{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Write(testConfig())
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	network, err := ioutil.ReadFile(filepath.Join(outputDir, "wgntest0.network"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "[Link]\nRequiredForOnline = no\n"; string(network) != want {
+		t.Errorf("rendered %q, want %q", network, want)
+	}
+	netdev, err := ioutil.ReadFile(filepath.Join(outputDir, "wgntest0.netdev"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(netdev), "[NetDev]") {
+		t.Errorf("built-in netdev template not used:\n%s", netdev)
+	}
+}
+
+// checkCommands compares the commands run with the expected commands
+func checkCommands(t *testing.T, runner *fakeRunner, want ...string) {
+	t.Helper()
+	if strings.Join(runner.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ran %q, want %q", runner.commands, want)
+	}
+	runner.commands = nil
+	runner.stdins = nil
+}
+
+func TestNetworkManagerBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "wgntest0.nmconnection")
+
+	runner := &fakeRunner{}
+	backend, err := NewBackend("networkmanager", BackendOptions{
+		InterfaceName: "wgntest0",
+		ConfigPath:    configPath,
+		VerifyTimeout: -1,
+		Runner:        runner,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Prepare()
+	if err != nil {
+		t.Fatalf("prepare failed: %v", err)
+	}
+	err = backend.Write(testConfig())
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	info, err := os.Stat(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("keyfile has mode %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+	err = backend.Apply()
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	checkCommands(t, runner, "nmcli connection load "+configPath, "nmcli connection up wgntest0")
+
+	err = backend.Prepare()
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("got error %v, want %v", err, os.ErrExist)
+	}
+	err = backend.Remove()
+	if err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	checkCommands(t, runner, "nmcli connection delete wgntest0")
+	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
+		t.Errorf("keyfile not removed: %v", err)
+	}
+}
+
+func TestNetworkManagerBackendRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "wgntest0.nmconnection")
+
+	runner := &fakeRunner{}
+	backend, err := NewBackend("networkmanager", BackendOptions{
+		InterfaceName: "wgntest0",
+		ConfigPath:    configPath,
+		Runner:        runner,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Write(testConfig())
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	err = backend.Rollback()
+	if err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	// A created connection is deleted instead of brought up again
+	checkCommands(t, runner, "nmcli connection delete wgntest0")
+	if _, err := os.Stat(configPath); !os.IsNotExist(err) {
+		t.Errorf("keyfile not removed: %v", err)
+	}
+}
+
+func TestIfupdownBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "wgntest0")
+	wireGuardConfigPath := filepath.Join(dir, "wgntest0.conf")
+
+	runner := &fakeRunner{}
+	backend, err := NewBackend("ifupdown", BackendOptions{
+		InterfaceName:       "wgntest0",
+		ConfigPath:          configPath,
+		WireGuardConfigPath: wireGuardConfigPath,
+		VerifyTimeout:       -1,
+		Runner:              runner,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Prepare()
+	if err != nil {
+		t.Fatalf("prepare failed: %v", err)
+	}
+	err = backend.Write(testConfig())
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	interfaces, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(interfaces), "pre-up wg setconf $IFACE "+wireGuardConfigPath+"\n") {
+		t.Errorf("interfaces missing wg setconf:\n%s", interfaces)
+	}
+	if strings.Contains(string(interfaces), testConfig().PrivateKey) {
+		t.Errorf("interfaces contains private key:\n%s", interfaces)
+	}
+	info, err := os.Stat(wireGuardConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("WireGuard configuration has mode %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+	err = backend.Apply()
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	checkCommands(t, runner, "ifup wgntest0")
+
+	err = backend.Remove()
+	if err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	checkCommands(t, runner, "ifdown wgntest0")
+	for _, path := range []string{configPath, wireGuardConfigPath} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%v not removed: %v", path, err)
+		}
+	}
+}
+
+func TestNetplanBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "90-wgntest0.yaml")
+
+	existing := []byte("network:\n  version: 2\n")
+	err = ioutil.WriteFile(configPath, existing, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runner := &fakeRunner{}
+	device := &fakeDevice{}
+	backend, err := NewBackend("netplan", BackendOptions{
+		InterfaceName: "wgntest0",
+		ConfigPath:    configPath,
+		VerifyTimeout: -1,
+		Runner:        runner,
+		Device:        device,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Prepare()
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("got error %v, want %v", err, os.ErrExist)
+	}
+	err = backend.Write(testConfig())
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	netplan, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(netplan), "      mode: wireguard\n") {
+		t.Errorf("netplan missing tunnel:\n%s", netplan)
+	}
+	err = backend.Apply()
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	checkCommands(t, runner, "netplan apply")
+	// The interface did not exist, so netplan creates it
+	if len(device.configs) != 0 {
+		t.Errorf("configured device %v times, want 0", len(device.configs))
+	}
+
+	err = backend.Rollback()
+	if err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	checkCommands(t, runner, "netplan apply")
+	netplan, err = ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(netplan) != string(existing) {
+		t.Errorf("netplan not restored:\n%s", netplan)
+	}
+}
+
+func TestUCIBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "network")
+
+	// OpenWrt creates the network package readable by others
+	err = ioutil.WriteFile(configPath, []byte("config interface 'lan'\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := []byte("package network\n")
+	runner := &fakeRunner{
+		outputs: map[string][]byte{
+			"uci -X show network": []byte("network.lan=interface\nnetwork.lan.proto='static'\nnetwork.wgntest0=interface\nnetwork.cfg0a1b2c=wireguard_wgntest0\nnetwork.cfg0a1b2c.public_key='key'\n"),
+			"uci export network":  previous,
+		},
+		errors: map[string]error{
+			"uci -q get network.wgntest0": &exec.ExitError{},
+		},
+	}
+	backend, err := NewBackend("uci", BackendOptions{
+		InterfaceName: "wgntest0",
+		ConfigPath:    configPath,
+		VerifyTimeout: -1,
+		Runner:        runner,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Prepare()
+	if err != nil {
+		t.Fatalf("prepare failed: %v", err)
+	}
+	checkCommands(t, runner, "uci -q get network.wgntest0")
+
+	err = backend.Write(testConfig())
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	batch := string(runner.stdins[len(runner.stdins)-1])
+	checkCommands(t, runner, "uci -X show network", "uci export network", "uci batch")
+	// Sections of an earlier configuration are replaced
+	if !strings.HasPrefix(batch, "delete network.wgntest0\ndelete network.cfg0a1b2c\nset network.wgntest0=interface\n") {
+		t.Errorf("batch does not delete existing sections:\n%s", batch)
+	}
+	if strings.Contains(batch, "network.lan") {
+		t.Errorf("batch changes other sections:\n%s", batch)
+	}
+	if !strings.HasSuffix(batch, "commit network\n") {
+		t.Errorf("batch not committed:\n%s", batch)
+	}
+	info, err := os.Stat(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		t.Errorf("network package has mode %v", info.Mode().Perm())
+	}
+
+	err = backend.Apply()
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	checkCommands(t, runner, "/etc/init.d/network reload")
+
+	err = backend.Rollback()
+	if err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+	if string(runner.stdins[0]) != string(previous) {
+		t.Errorf("imported %q, want %q", runner.stdins[0], previous)
+	}
+	checkCommands(t, runner, "uci import network", "/etc/init.d/network reload")
+}
+
+func TestUserspaceBackend(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("userspace backend not supported on this platform")
+	}
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidfile := filepath.Join(dir, "lo.pid")
+
+	// The loopback interface stands in for a running daemon, so that the
+	// keys and peers are configured without starting one
+	config := testConfig()
+	config.InterfaceName = "lo"
+	config.InterfaceIPs = []string{"127.0.0.1/8"}
+	device := &fakeDevice{}
+	backend, err := NewBackend("userspace", BackendOptions{
+		InterfaceName: "lo",
+		ConfigPath:    pidfile,
+		StatePath:     filepath.Join(dir, "lo.json"),
+		VerifyTimeout: time.Second,
+		Runner:        &fakeRunner{},
+		Device:        device,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Prepare()
+	if err == nil {
+		t.Errorf("prepare succeeded with a running interface")
+	}
+	err = backend.Write(config)
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	err = backend.Apply()
+	if err != nil {
+		t.Fatalf("apply failed: %v", err)
+	}
+	if len(device.configs) != 1 {
+		t.Fatalf("configured device %v times, want 1", len(device.configs))
+	}
+	if device.configs[0].PrivateKey == nil || device.configs[0].PrivateKey.String() != config.PrivateKey {
+		t.Errorf("device configured without the private key")
+	}
+	if len(device.configs[0].Peers) != 1 || device.configs[0].Peers[0].PublicKey.String() != config.PublicKey {
+		t.Errorf("device configured with peers %v", device.configs[0].Peers)
+	}
+	// A running daemon is left running
+	err = backend.Rollback()
+	if err != nil {
+		t.Fatalf("rollback failed: %v", err)
+	}
+
+	// The interface is verified after it is configured
+	config.InterfaceIPs = []string{"192.0.2.2/32"}
+	err = backend.Write(config)
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	err = backend.Apply()
+	if err == nil {
+		t.Errorf("apply succeeded without the interface address")
+	}
+
+	// Remove stops the daemon in the pidfile
+	daemon := exec.Command("sleep", "60")
+	err = daemon.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(pidfile, []byte(strconv.Itoa(daemon.Process.Pid)+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Remove()
+	if err != nil {
+		t.Fatalf("remove failed: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- daemon.Wait()
+	}()
+	select {
+	case err = <-done:
+		if err == nil {
+			t.Errorf("daemon exited without being stopped")
+		}
+	case <-time.After(5 * time.Second):
+		daemon.Process.Kill()
+		t.Errorf("daemon not stopped")
+	}
+}
@@ -1,45 +1,381 @@
 package lib
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var (
+	ErrRequestFailed   = fmt.Errorf("request for peer config was not successful")
+	ErrRevoked         = fmt.Errorf("peer was revoked by the server")
+	ErrRejected        = fmt.Errorf("request for peer config was rejected by the server")
+	ErrExpired         = fmt.Errorf("request for peer config expired before it was approved")
+	ErrCancelled       = fmt.Errorf("request for peer config was cancelled as the server shut down")
+	ErrRequestNotFound = fmt.Errorf("request for peer config not found on the server")
+	ErrUnavailable     = fmt.Errorf("server is temporarily unavailable")
+	ErrInvalidRequest  = fmt.Errorf("server did not accept the request as valid")
+	ErrDuplicateKey    = fmt.Errorf("public key is already enrolled or pending on the server")
+	ErrPoolExhausted   = fmt.Errorf("server has no free address or prefix left")
+	ErrUnauthorized    = fmt.Errorf("server did not accept the request signature")
+	ErrCertificate     = fmt.Errorf("certificate not valid")
+	// Servers without the /v1/ API decide requests before responding
+	ErrAsyncUnsupported = fmt.Errorf("server does not support submitting requests without waiting")
+)
+
+// Intervals between polls for the status of a pending request
+const (
+	pollMinInterval = 1 * time.Second
+	pollMaxInterval = 30 * time.Second
+)
+
+// Intervals between retries after a transient failure, unless the server asks
+// for a different interval with Retry-After
+const (
+	retryMinInterval = 1 * time.Second
+	retryMaxInterval = 30 * time.Second
+)
+
+// Defaults of ClientOptions
+const (
+	DefaultClientTimeout = 30 * time.Second
+	DefaultClientRetries = 4
 )
 
-var ErrRequestFailed = fmt.Errorf("request for peer config was not successful")
+// longPollTimeout is the longest the server holds a long poll before
+// responding, which is added to the timeout of those requests
+const longPollTimeout = 60 * time.Second
+
+// ClientOptions configures the connection to the server
+type ClientOptions struct {
+	// Disable TLS verification
+	Insecure bool
+	// Path to a PEM bundle of certificate authorities that verify the server,
+	// instead of the system roots
+	CAFile string
+	// Paths to a PEM certificate and key presented to the server
+	CertFile string
+	KeyFile  string
+	// Proxy URL. Empty uses the proxy from the environment
+	Proxy string
+	// Timeout of each attempt of a request, excluding the time the server
+	// holds a long poll. 0 is DefaultClientTimeout
+	Timeout time.Duration
+	// Retries of a request after a transient failure. 0 is
+	// DefaultClientRetries, and a negative value disables retries
+	Retries int
+}
 
 type Client struct {
 	serverURL  string
 	httpClient *http.Client
+	timeout    time.Duration
+	retries    int
+
+	// Path prefix of the API of the server, found with Info on first use
+	apiLock sync.Mutex
+	api     *string
 }
 
-func NewClient(serverURL string, insecure bool) *Client {
-	httpClient := &http.Client{}
-	if insecure {
-		httpClient.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+func NewClient(serverURL string, options ClientOptions) (*Client, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: options.Insecure}
+	if options.CAFile != "" {
+		b, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s failed: %w", options.CAFile, err)
 		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("%w: no certificates found in %s", ErrCertificate, options.CAFile)
+		}
+		tlsConfig.RootCAs = roots
+	}
+	if options.CertFile != "" || options.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrCertificate, err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if options.Proxy != "" {
+		proxyURL, err := url.Parse(options.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrValueParse, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	timeout := options.Timeout
+	if timeout == 0 {
+		timeout = DefaultClientTimeout
+	}
+	retries := options.Retries
+	if retries == 0 {
+		retries = DefaultClientRetries
 	}
 	return &Client{
-		serverURL: serverURL,
-		// Client is not used in time or resource sensitive environments, therefore
-		// omitting timeout reduces code
-		httpClient: &http.Client{},
+		serverURL:  serverURL,
+		httpClient: &http.Client{Transport: transport},
+		timeout:    timeout,
+		retries:    retries,
+	}, nil
+}
+
+// ServerError is an unsuccessful response from the server. It matches the
+// error for its code, or for its status if the server sent no code, with
+// errors.Is
+type ServerError struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *ServerError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%v: %s", e.Unwrap(), e.Message)
 	}
+	return fmt.Sprintf("%v: status %d", e.Unwrap(), e.StatusCode)
 }
 
-func (c *Client) Request(publicKey string) (PeerConfigResponse, error) {
-	peerConfigRequest := url.Values{}
-	peerConfigRequest.Set("PublicKey", publicKey)
+func (e *ServerError) Unwrap() error {
+	switch e.Code {
+	case ErrorInvalidRequest:
+		return ErrInvalidRequest
+	case ErrorDuplicateKey:
+		return ErrDuplicateKey
+	case ErrorPrefixOverlaps:
+		return ErrPrefixOverlaps
+	case ErrorPoolExhausted:
+		return ErrPoolExhausted
+	case ErrorUnauthorized:
+		return ErrUnauthorized
+	case ErrorRevoked:
+		return ErrRevoked
+	case ErrorNotFound:
+		return ErrRequestNotFound
+	case ErrorUnavailable:
+		return ErrUnavailable
+	case ErrorRejected:
+		return ErrRejected
+	case ErrorExpired:
+		return ErrExpired
+	}
+	switch e.StatusCode {
+	case http.StatusBadRequest:
+		return ErrInvalidRequest
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusConflict:
+		return ErrDuplicateKey
+	case http.StatusGone:
+		return ErrRevoked
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return ErrUnavailable
+	}
+	return ErrRequestFailed
+}
+
+// responseError reads the error in an unsuccessful response
+func responseError(resp *http.Response) error {
+	serverError := &ServerError{StatusCode: resp.StatusCode}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		var errorResponse ErrorResponse
+		if json.NewDecoder(resp.Body).Decode(&errorResponse) == nil {
+			serverError.Code = errorResponse.Error
+			serverError.Message = errorResponse.Message
+		}
+	}
+	return serverError
+}
+
+// transient reports whether a response may succeed when retried
+func transient(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// permanent reports whether a connection failure fails again when retried
+func permanent(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var certificateInvalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &certificateInvalid) || errors.As(err, &hostname)
+}
+
+// maxDrainSize limits how much of a response body is read to reuse the
+// connection
+const maxDrainSize = 64 * 1024
+
+// closeBody reads the rest of a response body before closing it, so that the
+// connection can be reused
+func closeBody(body io.ReadCloser) {
+	io.Copy(ioutil.Discard, io.LimitReader(body, maxDrainSize))
+	body.Close()
+}
+
+// cancelBody cancels the context of a request when its body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// do sends a request, retrying with backoff after transient responses, and
+// after connection failures of GET requests. The request is built again for
+// each attempt, so that signatures are fresh. Each attempt times out after the
+// client timeout plus extra, which is the time the server may hold the
+// request
+func (c *Client) do(ctx context.Context, extra time.Duration, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	interval := retryMinInterval
+	for attempt := 0; ; attempt++ {
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		attemptCtx, cancel := context.WithTimeout(ctx, c.timeout+extra)
+		resp, err := c.httpClient.Do(req.WithContext(attemptCtx))
+		wait := interval
+		if err != nil {
+			cancel()
+			if ctx.Err() != nil || req.Method != "GET" || permanent(err) || attempt >= c.retries {
+				return nil, err
+			}
+		} else if transient(resp.StatusCode) && attempt < c.retries {
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				wait = time.Duration(seconds) * time.Second
+				if wait > retryMaxInterval {
+					wait = retryMaxInterval
+				}
+			}
+			closeBody(resp.Body)
+			cancel()
+		} else {
+			resp.Body = cancelBody{resp.Body, cancel}
+			return resp, nil
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		interval *= 2
+		if interval > retryMaxInterval {
+			interval = retryMaxInterval
+		}
+	}
+}
+
+// Info reads the protocol version and capabilities of the server. Servers
+// without the /v1/ API report protocol version 0 and no capabilities
+func (c *Client) Info(ctx context.Context) (ServerInfo, error) {
+	resp, err := c.do(ctx, 0, func() (*http.Request, error) {
+		return http.NewRequest("GET", c.serverURL+"/v1/info", nil)
+	})
+	if err != nil {
+		return ServerInfo{}, fmt.Errorf("unable to read server info: %w", err)
+	}
+	defer closeBody(resp.Body)
+	// Older servers answer unknown paths with 404 or the binary
+	if resp.StatusCode == http.StatusNotFound {
+		return ServerInfo{}, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return ServerInfo{}, responseError(resp)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		return ServerInfo{}, nil
+	}
+	decoder := json.NewDecoder(resp.Body)
+
+	var info ServerInfo
+	err = decoder.Decode(&info)
+	if err != nil {
+		return ServerInfo{}, fmt.Errorf("unable to read server info: %w", err)
+	}
+
+	return info, nil
+}
+
+// endpoint returns the URL of a path in the API of the server, using the
+// /v1/ API if the server has it
+func (c *Client) endpoint(ctx context.Context, path string) (string, bool, error) {
+	c.apiLock.Lock()
+	defer c.apiLock.Unlock()
+
+	if c.api == nil {
+		info, err := c.Info(ctx)
+		if err != nil {
+			return "", false, err
+		}
+		api := ""
+		if info.ProtocolVersion >= 1 {
+			api = "/v1"
+		}
+		c.api = &api
+	}
+	return c.serverURL + *c.api + path, *c.api != "", nil
+}
+
+// Request submits a request for peer config and waits until it is approved
+func (c *Client) Request(ctx context.Context, req PeerConfigRequest) (PeerConfigResponse, error) {
+	id, err := c.Submit(ctx, req)
+	if errors.Is(err, ErrAsyncUnsupported) {
+		return c.requestLegacy(ctx, req)
+	}
+	if err != nil {
+		return PeerConfigResponse{}, err
+	}
+	return c.Wait(ctx, id)
+}
+
+// legacyRequestTimeout is the longest a server without the /v1/ API is
+// waited for, which holds requests until they are decided
+const legacyRequestTimeout = 24 * time.Hour
 
-	resp, err := c.httpClient.PostForm(c.serverURL+"/request", peerConfigRequest)
+// requestLegacy submits a request to a server without the /v1/ API, which
+// responds once the request is approved
+func (c *Client) requestLegacy(ctx context.Context, req PeerConfigRequest) (PeerConfigResponse, error) {
+	body := []byte(requestForm(req).Encode())
+	resp, err := c.do(ctx, legacyRequestTimeout, func() (*http.Request, error) {
+		httpReq, err := http.NewRequest("POST", c.serverURL+"/request", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return httpReq, nil
+	})
 	if err != nil {
 		return PeerConfigResponse{}, fmt.Errorf("unable to request: %w", err)
 	}
+	defer closeBody(resp.Body)
 	if resp.StatusCode != http.StatusOK {
-		return PeerConfigResponse{}, ErrRequestFailed
+		return PeerConfigResponse{}, responseError(resp)
 	}
 	decoder := json.NewDecoder(resp.Body)
 
@@ -48,6 +384,272 @@ func (c *Client) Request(publicKey string) (PeerConfigResponse, error) {
 	if err != nil {
 		return PeerConfigResponse{}, fmt.Errorf("unable to request: %w", err)
 	}
+	return peerConfigResponse, nil
+}
+
+// Submit submits a request for peer config without waiting for approval,
+// returning the ID of the request. Servers without the /v1/ API return
+// ErrAsyncUnsupported, and must be sent the request with Request
+func (c *Client) Submit(ctx context.Context, req PeerConfigRequest) (string, error) {
+	endpoint, v1, err := c.endpoint(ctx, "/request")
+	if err != nil {
+		return "", fmt.Errorf("unable to request: %w", err)
+	}
+	if !v1 {
+		return "", ErrAsyncUnsupported
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("unable to request: %w", err)
+	}
+
+	resp, err := c.do(ctx, 0, func() (*http.Request, error) {
+		httpReq, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		return httpReq, nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to request: %w", err)
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusAccepted {
+		return "", responseError(resp)
+	}
+	decoder := json.NewDecoder(resp.Body)
+
+	var status PeerConfigRequestStatus
+	err = decoder.Decode(&status)
+	if err != nil {
+		return "", fmt.Errorf("unable to request: %w", err)
+	}
+
+	return status.ID, nil
+}
+
+// requestForm encodes a request for the legacy API
+func requestForm(req PeerConfigRequest) url.Values {
+	peerConfigRequest := url.Values{}
+	peerConfigRequest.Set("PublicKey", req.PublicKey)
+	if len(req.Endpoint) > 0 {
+		peerConfigRequest.Set("Endpoint", req.Endpoint)
+	}
+	if req.DelegatePrefixLength > 0 {
+		peerConfigRequest.Set("DelegatePrefixLength", strconv.Itoa(req.DelegatePrefixLength))
+	}
+	for _, prefix := range req.AdvertisedPrefixes {
+		peerConfigRequest.Add("AdvertisedPrefixes", prefix)
+	}
+	return peerConfigRequest
+}
+
+// Status returns the status of a submitted request. The server may wait a
+// while for a pending request to be decided before responding
+func (c *Client) Status(ctx context.Context, id string) (PeerConfigRequestStatus, error) {
+	endpoint, _, err := c.endpoint(ctx, "/request/"+url.PathEscape(id))
+	if err != nil {
+		return PeerConfigRequestStatus{}, fmt.Errorf("unable to read request status: %w", err)
+	}
+	resp, err := c.do(ctx, longPollTimeout, func() (*http.Request, error) {
+		return http.NewRequest("GET", endpoint, nil)
+	})
+	if err != nil {
+		return PeerConfigRequestStatus{}, fmt.Errorf("unable to read request status: %w", err)
+	}
+	defer closeBody(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return PeerConfigRequestStatus{}, fmt.Errorf("%w: %s", ErrRequestNotFound, id)
+	default:
+		return PeerConfigRequestStatus{}, responseError(resp)
+	}
+	decoder := json.NewDecoder(resp.Body)
+
+	var status PeerConfigRequestStatus
+	err = decoder.Decode(&status)
+	if err != nil {
+		return PeerConfigRequestStatus{}, fmt.Errorf("unable to read request status: %w", err)
+	}
+
+	return status, nil
+}
+
+// Wait polls the status of a submitted request with backoff until it is
+// approved, rejected or expired. Waiting can be resumed with the same ID, for
+// example after a restart
+func (c *Client) Wait(ctx context.Context, id string) (PeerConfigResponse, error) {
+	interval := pollMinInterval
+	for {
+		status, err := c.Status(ctx, id)
+		// The server is restarting, and keeps pending requests
+		if errors.Is(err, ErrUnavailable) && ctx.Err() == nil {
+			status.Status = StatusPending
+		} else if err != nil {
+			return PeerConfigResponse{}, err
+		}
+		switch status.Status {
+		case StatusPending:
+		case StatusApproved:
+			if status.Config == nil {
+				return PeerConfigResponse{}, ErrRequestFailed
+			}
+			return *status.Config, nil
+		case StatusRejected:
+			return PeerConfigResponse{}, ErrRejected
+		case StatusExpired:
+			return PeerConfigResponse{}, ErrExpired
+		case StatusCancelled:
+			return PeerConfigResponse{}, ErrCancelled
+		default:
+			return PeerConfigResponse{}, fmt.Errorf("%w: unknown status %s", ErrRequestFailed, status.Status)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return PeerConfigResponse{}, ctx.Err()
+		}
+		interval *= 2
+		if interval > pollMaxInterval {
+			interval = pollMaxInterval
+		}
+	}
+}
+
+// signedRequest returns a function that builds a request signed with the
+// private key of the peer, for each attempt of do
+func signedRequest(method string, endpoint string, contentType string, body []byte, privateKey wgtypes.Key, serverPublicKey wgtypes.Key) func() (*http.Request, error) {
+	return func() (*http.Request, error) {
+		req, err := http.NewRequest(method, endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		err = SignRequest(req, body, privateKey, serverPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		return req, nil
+	}
+}
+
+// Sync waits for a peer config with a version different from the given
+// version. If the peer config is unchanged when the server gives up waiting,
+// false is returned
+func (c *Client) Sync(ctx context.Context, privateKey wgtypes.Key, serverPublicKey wgtypes.Key, version int64) (PeerConfigResponse, bool, error) {
+	endpoint, _, err := c.endpoint(ctx, "/sync?Version="+strconv.FormatInt(version, 10))
+	if err != nil {
+		return PeerConfigResponse{}, false, fmt.Errorf("unable to sync: %w", err)
+	}
+
+	resp, err := c.do(ctx, longPollTimeout, signedRequest("GET", endpoint, "", nil, privateKey, serverPublicKey))
+	if err != nil {
+		return PeerConfigResponse{}, false, fmt.Errorf("unable to sync: %w", err)
+	}
+	defer closeBody(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return PeerConfigResponse{}, false, nil
+	default:
+		return PeerConfigResponse{}, false, responseError(resp)
+	}
+	decoder := json.NewDecoder(resp.Body)
+
+	var peerConfigResponse PeerConfigResponse
+	err = decoder.Decode(&peerConfigResponse)
+	if err != nil {
+		return PeerConfigResponse{}, false, fmt.Errorf("unable to sync: %w", err)
+	}
+
+	return peerConfigResponse, true, nil
+}
+
+// Endpoints lists the endpoints of other peers as observed by the server
+func (c *Client) Endpoints(ctx context.Context, privateKey wgtypes.Key, serverPublicKey wgtypes.Key) ([]PeerEndpoint, error) {
+	endpoint, _, err := c.endpoint(ctx, "/endpoints")
+	if err != nil {
+		return nil, fmt.Errorf("unable to list endpoints: %w", err)
+	}
+
+	resp, err := c.do(ctx, 0, signedRequest("GET", endpoint, "", nil, privateKey, serverPublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("unable to list endpoints: %w", err)
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+	decoder := json.NewDecoder(resp.Body)
+
+	var peerEndpointsResponse PeerEndpointsResponse
+	err = decoder.Decode(&peerEndpointsResponse)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list endpoints: %w", err)
+	}
+
+	return peerEndpointsResponse.Peers, nil
+}
+
+// Rotate replaces the public key of an enrolled peer, keeping its addresses.
+// The request is signed with the current private key
+func (c *Client) Rotate(ctx context.Context, privateKey wgtypes.Key, serverPublicKey wgtypes.Key, newPublicKey wgtypes.Key) (PeerConfigResponse, error) {
+	endpoint, v1, err := c.endpoint(ctx, "/rotate")
+	if err != nil {
+		return PeerConfigResponse{}, fmt.Errorf("unable to rotate: %w", err)
+	}
+	contentType := "application/x-www-form-urlencoded"
+	var body []byte
+	if v1 {
+		contentType = "application/json"
+		body, err = json.Marshal(RotateRequest{PublicKey: newPublicKey.String()})
+		if err != nil {
+			return PeerConfigResponse{}, fmt.Errorf("unable to rotate: %w", err)
+		}
+	} else {
+		form := url.Values{}
+		form.Set("PublicKey", newPublicKey.String())
+		body = []byte(form.Encode())
+	}
+
+	resp, err := c.do(ctx, 0, signedRequest("POST", endpoint, contentType, body, privateKey, serverPublicKey))
+	if err != nil {
+		return PeerConfigResponse{}, fmt.Errorf("unable to rotate: %w", err)
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return PeerConfigResponse{}, responseError(resp)
+	}
+	decoder := json.NewDecoder(resp.Body)
+
+	var peerConfigResponse PeerConfigResponse
+	err = decoder.Decode(&peerConfigResponse)
+	if err != nil {
+		return PeerConfigResponse{}, fmt.Errorf("unable to rotate: %w", err)
+	}
 
 	return peerConfigResponse, nil
 }
+
+// Leave deregisters the peer from the server, which frees its addresses
+func (c *Client) Leave(ctx context.Context, privateKey wgtypes.Key, serverPublicKey wgtypes.Key) error {
+	endpoint, _, err := c.endpoint(ctx, "/leave")
+	if err != nil {
+		return fmt.Errorf("unable to leave: %w", err)
+	}
+
+	resp, err := c.do(ctx, 0, signedRequest("POST", endpoint, "", nil, privateKey, serverPublicKey))
+	if err != nil {
+		return fmt.Errorf("unable to leave: %w", err)
+	}
+	defer closeBody(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	return nil
+}
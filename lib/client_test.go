@@ -0,0 +1,243 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestClientRequest(t *testing.T) {
+	// Servers without the /v1/ API respond once the request is decided
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/request":
+			r.ParseForm()
+			if r.PostForm.Get("PublicKey") == "rejected" {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(ErrorResponse{Error: ErrorRejected})
+				return
+			}
+			json.NewEncoder(w).Encode(PeerConfigResponse{InterfaceIPs: []string{"10.0.0.2/24"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client, err := NewClient(server.URL, ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := client.Request(context.Background(), PeerConfigRequest{PublicKey: "GtL7fZc/bLnqZldpVofMCD6hDjrK28SsdLxevJ+qtKU="})
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if len(resp.InterfaceIPs) != 1 || resp.InterfaceIPs[0] != "10.0.0.2/24" {
+		t.Errorf("got interface IPs %v", resp.InterfaceIPs)
+	}
+
+	_, err = client.Request(context.Background(), PeerConfigRequest{PublicKey: "rejected"})
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("got error %v, want %v", err, ErrRejected)
+	}
+	_, err = client.Submit(context.Background(), PeerConfigRequest{PublicKey: "GtL7fZc/bLnqZldpVofMCD6hDjrK28SsdLxevJ+qtKU="})
+	if !errors.Is(err, ErrAsyncUnsupported) {
+		t.Errorf("got error %v, want %v", err, ErrAsyncUnsupported)
+	}
+}
+
+func TestClientRequestV1(t *testing.T) {
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.URL.Path == "/v1/info":
+			json.NewEncoder(w).Encode(ServerInfo{ProtocolVersion: ProtocolVersion, Capabilities: []string{CapabilityAsyncRequest}})
+		case r.Method == "POST" && r.URL.Path == "/v1/request":
+			var req PeerConfigRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil || req.PublicKey == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(PeerConfigRequestStatus{ID: "1", Status: StatusPending})
+		case r.URL.Path == "/v1/request/1":
+			polls++
+			status := PeerConfigRequestStatus{ID: "1", Status: StatusPending}
+			if polls > 1 {
+				status.Status = StatusApproved
+				status.Config = &PeerConfigResponse{InterfaceIPs: []string{"10.0.0.2/24"}}
+			}
+			json.NewEncoder(w).Encode(status)
+		case r.URL.Path == "/v1/request/2":
+			json.NewEncoder(w).Encode(PeerConfigRequestStatus{ID: "2", Status: StatusRejected})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	client, err := NewClient(server.URL, ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := client.Info(context.Background())
+	if err != nil {
+		t.Fatalf("info failed: %v", err)
+	}
+	if info.ProtocolVersion != ProtocolVersion {
+		t.Errorf("got protocol version %v", info.ProtocolVersion)
+	}
+	resp, err := client.Request(context.Background(), PeerConfigRequest{PublicKey: "GtL7fZc/bLnqZldpVofMCD6hDjrK28SsdLxevJ+qtKU="})
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if len(resp.InterfaceIPs) != 1 || resp.InterfaceIPs[0] != "10.0.0.2/24" {
+		t.Errorf("got interface IPs %v", resp.InterfaceIPs)
+	}
+
+	_, err = client.Wait(context.Background(), "2")
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("got error %v, want %v", err, ErrRejected)
+	}
+	_, err = client.Wait(context.Background(), "3")
+	if !errors.Is(err, ErrRequestNotFound) {
+		t.Errorf("got error %v, want %v", err, ErrRequestNotFound)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/request":
+			attempts++
+			if attempts < 3 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(w).Encode(PeerConfigResponse{InterfaceIPs: []string{"10.0.0.2/24"}})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Request(context.Background(), PeerConfigRequest{PublicKey: "GtL7fZc/bLnqZldpVofMCD6hDjrK28SsdLxevJ+qtKU="})
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	if len(resp.InterfaceIPs) != 1 || attempts != 3 {
+		t.Errorf("got interface IPs %v after %v attempts", resp.InterfaceIPs, attempts)
+	}
+
+	attempts = 0
+	client, err = NewClient(server.URL, ClientOptions{Retries: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Request(context.Background(), PeerConfigRequest{PublicKey: "GtL7fZc/bLnqZldpVofMCD6hDjrK28SsdLxevJ+qtKU="})
+	if !errors.Is(err, ErrUnavailable) || attempts != 1 {
+		t.Errorf("got error %v after %v attempts, want %v", err, attempts, ErrUnavailable)
+	}
+}
+
+func TestClientServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Content-Type") {
+		case "application/x-www-form-urlencoded":
+			r.ParseForm()
+			switch r.PostForm.Get("PublicKey") {
+			case "duplicate":
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(ErrorResponse{Error: ErrorDuplicateKey})
+			case "exhausted":
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(ErrorResponse{Error: ErrorPoolExhausted, Message: "no free address"})
+			default:
+				w.WriteHeader(http.StatusBadRequest)
+			}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	client, err := NewClient(server.URL, ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		publicKey string
+		want      error
+	}{
+		{"duplicate", ErrDuplicateKey},
+		{"exhausted", ErrPoolExhausted},
+		{"invalid", ErrInvalidRequest},
+	}
+	for _, test := range tests {
+		_, err := client.Request(context.Background(), PeerConfigRequest{PublicKey: test.publicKey})
+		if !errors.Is(err, test.want) {
+			t.Errorf("got error %v for %v, want %v", err, test.publicKey, test.want)
+		}
+		var serverError *ServerError
+		if !errors.As(err, &serverError) {
+			t.Errorf("got error %v for %v, want ServerError", err, test.publicKey)
+		}
+	}
+}
+
+func TestClientTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ServerInfo{ProtocolVersion: ProtocolVersion})
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "wgn-client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	err = ioutil.WriteFile(caFile, ca, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		options ClientOptions
+		ok      bool
+	}{
+		{ClientOptions{}, false},
+		{ClientOptions{Insecure: true}, true},
+		{ClientOptions{CAFile: caFile}, true},
+	}
+	for _, test := range tests {
+		client, err := NewClient(server.URL, test.options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Info(context.Background())
+		if (err == nil) != test.ok {
+			t.Errorf("got error %v with options %+v", err, test.options)
+		}
+	}
+}
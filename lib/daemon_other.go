@@ -0,0 +1,16 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package lib
+
+import "fmt"
+
+var errUserspaceNotSupported = fmt.Errorf("userspace backend not supported on this platform")
+
+func daemonizeUserspace(statePath string, pidfile string) error {
+	return errUserspaceNotSupported
+}
+
+func stopUserspace(pidfile string) error {
+	return errUserspaceNotSupported
+}
@@ -0,0 +1,77 @@
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// userspaceStartTimeout is how long to wait for the daemon to start
+const userspaceStartTimeout = 10 * time.Second
+
+// daemonizeUserspace starts this executable again in the foreground in a new
+// session, and waits for the pidfile to show that it has started
+func daemonizeUserspace(statePath string, pidfile string) error {
+	bin, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	os.Remove(pidfile)
+	cmd := exec.Command(bin, "userspace", "--state", statePath, "--pidfile", pidfile, "--foreground")
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("starting userspace daemon failed: %w", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	deadline := time.After(userspaceStartTimeout)
+	for {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("userspace daemon exited: %v", err)
+		case <-deadline:
+			return fmt.Errorf("userspace daemon did not start within %v", userspaceStartTimeout)
+		case <-time.After(100 * time.Millisecond):
+		}
+		if _, err := os.Stat(pidfile); err == nil {
+			log.Printf("Userspace daemon started with PID %v\n", cmd.Process.Pid)
+			return nil
+		}
+	}
+}
+
+// stopUserspace terminates the daemon in the pidfile, if it is running
+func stopUserspace(pidfile string) error {
+	b, err := ioutil.ReadFile(pidfile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s failed: %w", pidfile, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return fmt.Errorf("reading %s failed: %w", pidfile, err)
+	}
+	err = syscall.Kill(pid, syscall.SIGTERM)
+	if err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("stopping userspace daemon failed: %w", err)
+	}
+	return nil
+}
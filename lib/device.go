@@ -0,0 +1,213 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Device is the WireGuard interface managed by the server
+type Device interface {
+	// Read returns the interface and its peers, with endpoints observed from
+	// handshakes
+	Read() (*wgtypes.Device, error)
+	// Addresses lists the addresses of the interface. The IP of each address
+	// is the address of the interface, not of the network
+	Addresses() ([]net.IPNet, error)
+	// AddPeer adds a peer, or replaces the peer with the same public key
+	AddPeer(peer wgtypes.PeerConfig) error
+	// RemovePeer removes a peer
+	RemovePeer(publicKey wgtypes.Key) error
+	// Configure applies a configuration read from the config file, equivalent
+	// to wg setconf when it replaces peers
+	Configure(config wgtypes.Config) error
+}
+
+// WgctrlDevice manages a WireGuard interface on the system with wgctrl
+type WgctrlDevice struct {
+	Name string
+}
+
+func (d WgctrlDevice) Read() (*wgtypes.Device, error) {
+	client, err := wgctrl.New()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	device, err := client.Device(d.Name)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s failed: %w", d.Name, err)
+	}
+	return device, nil
+}
+
+func (d WgctrlDevice) Addresses() ([]net.IPNet, error) {
+	interf, err := net.InterfaceByName(d.Name)
+	if err != nil {
+		return nil, err
+	}
+	interfAddrs, err := interf.Addrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var addresses []net.IPNet
+	for _, interfAddr := range interfAddrs {
+		ip, ipNet, err := net.ParseCIDR(interfAddr.String())
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, net.IPNet{IP: ip, Mask: ipNet.Mask})
+	}
+	return addresses, nil
+}
+
+func (d WgctrlDevice) AddPeer(peer wgtypes.PeerConfig) error {
+	peer.ReplaceAllowedIPs = true
+	return WgctrlConfigurer{}.ConfigureDevice(d.Name, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{peer},
+	})
+}
+
+func (d WgctrlDevice) RemovePeer(publicKey wgtypes.Key) error {
+	return WgctrlConfigurer{}.ConfigureDevice(d.Name, wgtypes.Config{
+		Peers: []wgtypes.PeerConfig{{PublicKey: publicKey, Remove: true}},
+	})
+}
+
+func (d WgctrlDevice) Configure(config wgtypes.Config) error {
+	return WgctrlConfigurer{}.ConfigureDevice(d.Name, config)
+}
+
+// MemoryDevice is an in-memory Device, for running the server without a
+// WireGuard interface, such as in tests
+type MemoryDevice struct {
+	lock       sync.Mutex
+	name       string
+	privateKey wgtypes.Key
+	listenPort int
+	addresses  []net.IPNet
+	peers      map[wgtypes.Key]wgtypes.Peer
+}
+
+// NewMemoryDevice creates an in-memory Device with the given interface
+// addresses
+func NewMemoryDevice(name string, addresses ...net.IPNet) *MemoryDevice {
+	return &MemoryDevice{
+		name:      name,
+		addresses: addresses,
+		peers:     make(map[wgtypes.Key]wgtypes.Peer),
+	}
+}
+
+func (d *MemoryDevice) Read() (*wgtypes.Device, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	device := &wgtypes.Device{
+		Name:       d.name,
+		Type:       wgtypes.Userspace,
+		PrivateKey: d.privateKey,
+		ListenPort: d.listenPort,
+	}
+	if d.privateKey != (wgtypes.Key{}) {
+		device.PublicKey = d.privateKey.PublicKey()
+	}
+	for _, peer := range d.peers {
+		device.Peers = append(device.Peers, peer)
+	}
+	sort.Slice(device.Peers, func(i, j int) bool {
+		return device.Peers[i].PublicKey.String() < device.Peers[j].PublicKey.String()
+	})
+	return device, nil
+}
+
+func (d *MemoryDevice) Addresses() ([]net.IPNet, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return append([]net.IPNet(nil), d.addresses...), nil
+}
+
+func (d *MemoryDevice) AddPeer(peer wgtypes.PeerConfig) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	peer.ReplaceAllowedIPs = true
+	d.configurePeer(peer)
+	return nil
+}
+
+func (d *MemoryDevice) RemovePeer(publicKey wgtypes.Key) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	delete(d.peers, publicKey)
+	return nil
+}
+
+func (d *MemoryDevice) Configure(config wgtypes.Config) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if config.PrivateKey != nil {
+		d.privateKey = *config.PrivateKey
+	}
+	if config.ListenPort != nil {
+		d.listenPort = *config.ListenPort
+	}
+	if config.ReplacePeers {
+		d.peers = make(map[wgtypes.Key]wgtypes.Peer)
+	}
+	for _, peer := range config.Peers {
+		if peer.Remove {
+			delete(d.peers, peer.PublicKey)
+			continue
+		}
+		d.configurePeer(peer)
+	}
+	return nil
+}
+
+// configurePeer adds or updates a peer like the kernel does. The lock must
+// be held
+func (d *MemoryDevice) configurePeer(peer wgtypes.PeerConfig) {
+	p := d.peers[peer.PublicKey]
+	p.PublicKey = peer.PublicKey
+	if peer.PresharedKey != nil {
+		p.PresharedKey = *peer.PresharedKey
+	}
+	if peer.Endpoint != nil {
+		p.Endpoint = peer.Endpoint
+	}
+	if peer.PersistentKeepaliveInterval != nil {
+		p.PersistentKeepaliveInterval = *peer.PersistentKeepaliveInterval
+	}
+	if peer.ReplaceAllowedIPs {
+		p.AllowedIPs = nil
+	}
+	p.AllowedIPs = append(append([]net.IPNet(nil), p.AllowedIPs...), peer.AllowedIPs...)
+	d.peers[peer.PublicKey] = p
+}
+
+// SetEndpoint records a handshake from a peer at endpoint, as a WireGuard
+// interface would
+func (d *MemoryDevice) SetEndpoint(publicKey wgtypes.Key, endpoint *net.UDPAddr) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	p, ok := d.peers[publicKey]
+	if !ok {
+		return fmt.Errorf("%w: %v", ErrPeerNotFound, publicKey)
+	}
+	p.Endpoint = endpoint
+	p.LastHandshakeTime = time.Now()
+	d.peers[publicKey] = p
+	return nil
+}
@@ -0,0 +1,629 @@
+package lib
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EnrollmentRequest is a request for peer config with the address and
+// prefixes assigned to it, from submission until it is decided
+type EnrollmentRequest struct {
+	// ID given to the client to poll for the result
+	ID                string
+	PublicKey         string
+	PresharedKey      string
+	Endpoint          string
+	IP                net.IP
+	DelegatedPrefixes []net.IPNet
+}
+
+// Gate decides whether requests are approved. Requests are gated one at a
+// time, in the order they were submitted
+type Gate interface {
+	// Allow reports whether the request is approved. An error stops gating,
+	// and later requests stay pending until the server is restarted
+	Allow(req EnrollmentRequest) (bool, error)
+}
+
+// GateFunc is a function used as a Gate
+type GateFunc func(req EnrollmentRequest) (bool, error)
+
+func (f GateFunc) Allow(req EnrollmentRequest) (bool, error) {
+	return f(req)
+}
+
+// AllowAll approves every request
+var AllowAll = GateFunc(func(req EnrollmentRequest) (bool, error) {
+	return true, nil
+})
+
+// PromptGate asks the admin whether to approve each request
+type PromptGate struct {
+	reader *bufio.Reader
+	writer io.Writer
+}
+
+func NewPromptGate(r io.Reader, w io.Writer) *PromptGate {
+	return &PromptGate{
+		reader: bufio.NewReader(r),
+		writer: w,
+	}
+}
+
+func (g *PromptGate) Allow(req EnrollmentRequest) (bool, error) {
+	fmt.Fprintln(g.writer, req.IP.String(), req.PublicKey)
+	for {
+		fmt.Fprint(g.writer, "Allow? (y/n) ")
+		line, err := g.reader.ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+
+		switch strings.TrimSpace(line) {
+		case "y", "yes":
+			return true, nil
+		case "n", "no":
+			return false, nil
+		}
+	}
+}
+
+// Store saves requests, so that pending requests survive a restart
+type Store interface {
+	// Load returns the saved requests
+	Load() ([]EnrollmentRecord, error)
+	// Save replaces the saved requests
+	Save(records []EnrollmentRecord) error
+}
+
+// EnrollmentRecord is a request as saved in a Store
+type EnrollmentRecord struct {
+	ID                string
+	PublicKey         string
+	PresharedKey      string `json:",omitempty"`
+	Endpoint          string `json:",omitempty"`
+	IP                string
+	DelegatedPrefixes []string `json:",omitempty"`
+	Status            string
+	Created           time.Time
+	Decided           time.Time
+}
+
+// FileStore saves requests to a JSON file
+type FileStore struct {
+	Path string
+}
+
+func (f FileStore) Load() ([]EnrollmentRecord, error) {
+	b, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading %s failed: %w", f.Path, err)
+	}
+	var records []EnrollmentRecord
+	err = json.Unmarshal(b, &records)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s failed: %w", f.Path, err)
+	}
+	return records, nil
+}
+
+func (f FileStore) Save(records []EnrollmentRecord) error {
+	b, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	// Requests contain preshared keys
+	err = os.MkdirAll(filepath.Dir(f.Path), 0700)
+	if err != nil {
+		return fmt.Errorf("creating %s failed: %w", filepath.Dir(f.Path), err)
+	}
+	tmp := f.Path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("writing %s failed: %w", tmp, err)
+	}
+	err = os.Rename(tmp, f.Path)
+	if err != nil {
+		return fmt.Errorf("writing %s failed: %w", f.Path, err)
+	}
+	return nil
+}
+
+// enroller gates requests and adds approved peers. When stopped, it takes no
+// more requests, but finishes adding a peer that is being added. Requests that
+// are not yet added stay pending, and are gated again after a restart
+type enroller struct {
+	gateQueue   chan EnrollmentRequest
+	addQueue    chan EnrollmentRequest
+	gate        Gate
+	enrollments *enrollments
+	// apply adds an approved peer to the config and the interface
+	apply  func(EnrollmentRequest) error
+	finish func(EnrollmentRequest, string)
+
+	stopOnce sync.Once
+	stopping chan struct{}
+	// Closed when the adder returned
+	stopped chan struct{}
+}
+
+// gateQueueSize is how many requests may wait for the gate
+const gateQueueSize = 1024
+
+func newEnroller(gate Gate, enrollments *enrollments, apply func(EnrollmentRequest) error, finish func(EnrollmentRequest, string)) *enroller {
+	return &enroller{
+		gateQueue:   make(chan EnrollmentRequest, gateQueueSize),
+		addQueue:    make(chan EnrollmentRequest),
+		gate:        gate,
+		enrollments: enrollments,
+		apply:       apply,
+		finish:      finish,
+		stopping:    make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+}
+
+// start runs the gater and the adder
+func (e *enroller) start() {
+	go e.gater()
+	go e.adder()
+}
+
+// submit queues a request at the gate without waiting for the admin.
+// Requests are gated in the order they were submitted
+func (e *enroller) submit(req EnrollmentRequest) error {
+	if e.isStopping() {
+		return ErrShuttingDown
+	}
+	select {
+	case e.gateQueue <- req:
+		return nil
+	default:
+		return ErrTooManyPending
+	}
+}
+
+func (e *enroller) isStopping() bool {
+	select {
+	case <-e.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// stop stops taking requests. Pending requests are no longer gated
+func (e *enroller) stop() {
+	e.stopOnce.Do(func() {
+		close(e.stopping)
+	})
+}
+
+// wait waits until a peer that was being added when stopped is added
+func (e *enroller) wait(ctx context.Context) error {
+	select {
+	case <-e.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *enroller) adder() {
+	defer close(e.stopped)
+	// Write requests to config and add peer
+	for {
+		select {
+		case <-e.stopping:
+			return
+		case req := <-e.addQueue:
+			if !e.enrollments.claim(req.ID) {
+				log.Printf("Request from %v expired before it was approved\n", req.PublicKey)
+				continue
+			}
+			err := e.apply(req)
+			if err != nil {
+				log.Println(err)
+				e.finish(req, StatusRejected)
+				continue
+			}
+			e.finish(req, StatusApproved)
+		}
+	}
+}
+
+func (e *enroller) gater() {
+	// Receive requests and ask the gate
+	for {
+		var req EnrollmentRequest
+		select {
+		case <-e.stopping:
+			return
+		case req = <-e.gateQueue:
+		}
+		if !e.enrollments.pending(req.ID) {
+			continue
+		}
+		allowed, err := e.gate.Allow(req)
+		if err != nil {
+			log.Printf("Gate failed, requests stay pending: %v\n", err)
+			return
+		}
+		if !allowed {
+			e.finish(req, StatusRejected)
+			continue
+		}
+		select {
+		case e.addQueue <- req:
+		case <-e.stopping:
+			return
+		}
+	}
+}
+
+// syncTimeout is how long a sync request waits for a change in
+// configuration. Tests shorten it
+var syncTimeout = 60 * time.Second
+
+// versioner tracks the version of the configuration, so that agents can wait
+// for changes
+type versioner struct {
+	sync.Mutex
+	version int64
+	changed chan struct{}
+}
+
+func newVersioner() *versioner {
+	// Versions must not repeat across restarts
+	return &versioner{
+		version: time.Now().UnixNano(),
+		changed: make(chan struct{}),
+	}
+}
+
+// current returns the current version and a channel that is closed when the
+// version changes
+func (v *versioner) current() (int64, <-chan struct{}) {
+	v.Lock()
+	defer v.Unlock()
+	return v.version, v.changed
+}
+
+func (v *versioner) bump() {
+	v.Lock()
+	defer v.Unlock()
+	v.version = time.Now().UnixNano()
+	close(v.changed)
+	v.changed = make(chan struct{})
+}
+
+// expireInterval is how often pending requests are checked for expiry
+const expireInterval = 10 * time.Second
+
+// enrollmentRetention is how long the result of a decided request can be read
+const enrollmentRetention = 1 * time.Hour
+
+// abandonTimeout is how long a pending request stays after its client stopped
+// waiting for it, so that a restarted client can resume waiting
+const abandonTimeout = 2 * time.Minute
+
+// statusTimeout is how long a status request waits for a pending request to
+// be decided
+const statusTimeout = 20 * time.Second
+
+// enrollments tracks requests from submission until some time after they are
+// decided, so that clients can poll for the result. Requests are saved to the
+// store, if any, so that pending requests survive a restart
+type enrollments struct {
+	sync.Mutex
+	store Store
+	// How long a request may stay pending
+	ttl      time.Duration
+	requests map[string]*enrollment
+}
+
+type enrollment struct {
+	req     EnrollmentRequest
+	status  string
+	created time.Time
+	decided time.Time
+	// When a client last stopped waiting, and the number of clients waiting
+	lastSeen time.Time
+	waiters  int
+	// Whether the peer is being added, so the request no longer expires
+	claimed bool
+	// Closed when the request is decided
+	done chan struct{}
+}
+
+// newEnrollments loads saved requests, returning those that are still
+// pending in the order they were submitted
+func newEnrollments(store Store, ttl time.Duration) (*enrollments, []EnrollmentRequest, error) {
+	e := &enrollments{
+		store:    store,
+		ttl:      ttl,
+		requests: make(map[string]*enrollment),
+	}
+	if store == nil {
+		return e, nil, nil
+	}
+
+	records, err := store.Load()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var pending []EnrollmentRequest
+	for _, record := range records {
+		req := EnrollmentRequest{
+			ID:           record.ID,
+			PublicKey:    record.PublicKey,
+			PresharedKey: record.PresharedKey,
+			Endpoint:     record.Endpoint,
+			IP:           net.ParseIP(record.IP),
+		}
+		for _, prefix := range record.DelegatedPrefixes {
+			_, ipNet, err := net.ParseCIDR(prefix)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%w: %v", ErrValueParse, err)
+			}
+			req.DelegatedPrefixes = append(req.DelegatedPrefixes, *ipNet)
+		}
+		existing := &enrollment{
+			req:      req,
+			status:   record.Status,
+			created:  record.Created,
+			decided:  record.Decided,
+			lastSeen: time.Now(),
+			done:     make(chan struct{}),
+		}
+		if record.Status == StatusPending {
+			pending = append(pending, req)
+		} else {
+			close(existing.done)
+		}
+		e.requests[req.ID] = existing
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return e.requests[pending[i].ID].created.Before(e.requests[pending[j].ID].created)
+	})
+	return e, pending, nil
+}
+
+// save writes every request to the store. The caller must hold the lock
+func (e *enrollments) save() error {
+	if e.store == nil {
+		return nil
+	}
+	records := []EnrollmentRecord{}
+	for id, existing := range e.requests {
+		record := EnrollmentRecord{
+			ID:           id,
+			PublicKey:    existing.req.PublicKey,
+			PresharedKey: existing.req.PresharedKey,
+			Endpoint:     existing.req.Endpoint,
+			IP:           existing.req.IP.String(),
+			Status:       existing.status,
+			Created:      existing.created,
+			Decided:      existing.decided,
+		}
+		for _, prefix := range existing.req.DelegatedPrefixes {
+			record.DelegatedPrefixes = append(record.DelegatedPrefixes, prefix.String())
+		}
+		records = append(records, record)
+	}
+	return e.store.Save(records)
+}
+
+// add records a pending request, returning its new ID. Only one request for
+// each public key can be pending
+func (e *enrollments) add(req EnrollmentRequest) (string, error) {
+	e.Lock()
+	defer e.Unlock()
+
+	for _, existing := range e.requests {
+		if existing.status == StatusPending && existing.req.PublicKey == req.PublicKey {
+			return "", fmt.Errorf("%w: %s is pending", ErrPeerExists, req.PublicKey)
+		}
+	}
+
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	req.ID = hex.EncodeToString(b)
+	now := time.Now()
+	e.requests[req.ID] = &enrollment{
+		req:      req,
+		status:   StatusPending,
+		created:  now,
+		lastSeen: now,
+		done:     make(chan struct{}),
+	}
+	err = e.save()
+	if err != nil {
+		delete(e.requests, req.ID)
+		return "", err
+	}
+	return req.ID, nil
+}
+
+// claim marks a pending request as being added, so that it does not expire.
+// It reports whether the request is still pending
+func (e *enrollments) claim(id string) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	existing, ok := e.requests[id]
+	if !ok || existing.status != StatusPending {
+		return false
+	}
+	existing.claimed = true
+	return true
+}
+
+// finish records the decision on a pending request. It reports whether the
+// request was pending, so that its reservations are released only once
+func (e *enrollments) finish(id string, status string) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	existing, ok := e.requests[id]
+	if !ok || existing.status != StatusPending {
+		return false
+	}
+	e.decide(existing, status)
+	err := e.save()
+	if err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+// cancel records that a pending request was cancelled, unless its peer is
+// being added. It reports whether the request was cancelled
+func (e *enrollments) cancel(id string) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	existing, ok := e.requests[id]
+	if !ok || existing.status != StatusPending || existing.claimed {
+		return false
+	}
+	e.decide(existing, StatusCancelled)
+	err := e.save()
+	if err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+// cancelPending cancels every pending request whose peer is not being added,
+// returning the cancelled requests
+func (e *enrollments) cancelPending() []EnrollmentRequest {
+	e.Lock()
+	defer e.Unlock()
+
+	var cancelled []EnrollmentRequest
+	for _, existing := range e.requests {
+		if existing.status == StatusPending && !existing.claimed {
+			e.decide(existing, StatusCancelled)
+			cancelled = append(cancelled, existing.req)
+		}
+	}
+	if len(cancelled) > 0 {
+		err := e.save()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return cancelled
+}
+
+// decide sets the status of a pending request. The caller must hold the lock
+func (e *enrollments) decide(existing *enrollment, status string) {
+	existing.status = status
+	existing.decided = time.Now()
+	close(existing.done)
+}
+
+// expire marks requests that stayed pending longer than the TTL, or that no
+// client waited for within abandonTimeout, as expired, and forgets old
+// results. It returns the expired requests
+func (e *enrollments) expire() []EnrollmentRequest {
+	e.Lock()
+	defer e.Unlock()
+
+	var expired []EnrollmentRequest
+	changed := false
+	for id, existing := range e.requests {
+		if existing.status != StatusPending {
+			if time.Since(existing.decided) > enrollmentRetention {
+				delete(e.requests, id)
+				changed = true
+			}
+			continue
+		}
+		if existing.claimed {
+			continue
+		}
+		abandoned := existing.waiters == 0 && time.Since(existing.lastSeen) > abandonTimeout
+		if abandoned || e.ttl > 0 && time.Since(existing.created) > e.ttl {
+			e.decide(existing, StatusExpired)
+			expired = append(expired, existing.req)
+			changed = true
+		}
+	}
+	if changed {
+		err := e.save()
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	return expired
+}
+
+// wait registers a client waiting for the request, returning a channel that
+// is closed when the request is decided. The client must call stopWaiting
+func (e *enrollments) wait(id string) (<-chan struct{}, bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	existing, ok := e.requests[id]
+	if !ok {
+		return nil, false
+	}
+	existing.waiters += 1
+	return existing.done, true
+}
+
+func (e *enrollments) stopWaiting(id string) {
+	e.Lock()
+	defer e.Unlock()
+
+	existing, ok := e.requests[id]
+	if !ok {
+		return
+	}
+	existing.waiters -= 1
+	existing.lastSeen = time.Now()
+}
+
+// pending reports whether the request is still pending
+func (e *enrollments) pending(id string) bool {
+	e.Lock()
+	defer e.Unlock()
+
+	existing, ok := e.requests[id]
+	return ok && existing.status == StatusPending
+}
+
+func (e *enrollments) get(id string) (enrollment, bool) {
+	e.Lock()
+	defer e.Unlock()
+
+	found, ok := e.requests[id]
+	if !ok {
+		return enrollment{}, false
+	}
+	return *found, true
+}
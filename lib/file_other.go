@@ -0,0 +1,11 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package lib
+
+import "os"
+
+// fileGroup returns -1, as files have no owning group on this platform
+func fileGroup(info os.FileInfo) int {
+	return -1
+}
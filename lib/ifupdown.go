@@ -0,0 +1,172 @@
+package lib
+
+func init() {
+	RegisterBackend("ifupdown", newIfupdownBackend)
+}
+
+// wireguardTemplate renders a configuration file for wg setconf, which does not
+// include addresses
+const wireguardTemplate = `[Interface]
+PrivateKey = {{.PrivateKey}}
+{{- if .ListenPort}}
+ListenPort = {{.ListenPort}}
+{{- end}}
+{{- if .FullTunnel}}
+FwMark = {{fullTunnelMark}}
+{{- end}}
+
+[Peer]
+PublicKey = {{.PublicKey}}
+{{- if .PresharedKey}}
+PresharedKey = {{.PresharedKey}}
+{{- end}}
+AllowedIPs = {{join .AllowedIPs ", "}}
+Endpoint = {{.Endpoint}}
+PersistentKeepalive = {{.PersistentKeepalive}}
+{{range .Peers}}
+[Peer]
+PublicKey = {{.PublicKey}}
+AllowedIPs = {{join .AllowedIPs ", "}}
+{{- if .Endpoint}}
+Endpoint = {{.Endpoint}}
+{{- end}}
+{{- if .PersistentKeepalive}}
+PersistentKeepalive = {{.PersistentKeepalive}}
+{{- end}}
+{{end}}`
+
+const ifupdownTemplate = `# WireGuard {{.InterfaceName}} generated with wireguard-negotiator
+auto {{.InterfaceName}}
+iface {{.InterfaceName}} inet manual
+	pre-up ip link add $IFACE type wireguard
+	pre-up wg setconf $IFACE {{.WireGuardConfig}}
+{{- if .MTU}}
+	pre-up ip link set $IFACE mtu {{.MTU}}
+{{- end}}
+	up ip link set $IFACE up
+{{- range .InterfaceIPs}}
+	up ip address add {{.}} dev $IFACE
+{{- end}}
+{{- range withoutDefaultRoutes .Routes}}
+	up ip route add {{.}} dev $IFACE
+{{- end}}
+{{- if .FullTunnel}}
+{{- range $i, $family := families}}
+	up ip {{$family}} route add default dev $IFACE table {{fullTunnelTable}}
+	up ip {{$family}} rule add not fwmark {{fullTunnelMark}} table {{fullTunnelTable}}
+	up ip {{$family}} rule add table main suppress_prefixlength 0
+	down ip {{$family}} rule del not fwmark {{fullTunnelMark}} table {{fullTunnelTable}}
+	down ip {{$family}} rule del table main suppress_prefixlength 0
+{{- end}}
+{{- end}}
+{{- if .DNS}}
+	dns-nameservers {{join .DNS " "}}
+{{- end}}
+{{- if .DNSSearch}}
+	dns-search {{join .DNSSearch " "}}
+{{- end}}
+{{- if .DelegatedPrefixes}}
+	up sysctl -w net.ipv4.ip_forward=1 net.ipv6.conf.all.forwarding=1
+{{- end}}
+	post-down ip link delete $IFACE
+`
+
+type ifupdownConfig struct {
+	InterfaceAndPeerConfig
+	WireGuardConfig string
+}
+
+// ifupdownBackend writes an interfaces stanza, and a WireGuard configuration
+// file that it loads with wg setconf
+type ifupdownBackend struct {
+	options BackendOptions
+	files   fileSet
+	config  InterfaceAndPeerConfig
+	existed bool
+	changed bool
+}
+
+func newIfupdownBackend(options BackendOptions) Backend {
+	if options.ConfigPath == "" {
+		options.ConfigPath = "/etc/network/interfaces.d/" + options.InterfaceName
+	}
+	if options.WireGuardConfigPath == "" {
+		options.WireGuardConfigPath = "/etc/wireguard/" + options.InterfaceName + ".conf"
+	}
+	return &ifupdownBackend{options: options}
+}
+
+func (b *ifupdownBackend) Prepare() error {
+	return checkNotExist(b.options.ConfigPath, b.options.WireGuardConfigPath)
+}
+
+func (b *ifupdownBackend) Write(config InterfaceAndPeerConfig) error {
+	wireguard, err := renderTemplate(b.options.TemplateDir, "wireguard", wireguardTemplate, config)
+	if err != nil {
+		return err
+	}
+	interfaces, err := renderTemplate(b.options.TemplateDir, "ifupdown", ifupdownTemplate, ifupdownConfig{config, b.options.WireGuardConfigPath})
+	if err != nil {
+		return err
+	}
+
+	b.files = fileSet{secrets: config.secrets()}
+	b.config = config
+	b.existed = interfaceExists(b.options.InterfaceName)
+	b.files.stage(b.options.WireGuardConfigPath, wireguard, 0600)
+	b.files.stage(b.options.ConfigPath, interfaces, 0644)
+	changed, err := b.files.commit()
+	if err != nil {
+		return err
+	}
+	b.changed = b.changed || changed
+	return nil
+}
+
+func (b *ifupdownBackend) Apply() error {
+	if !b.changed {
+		return nil
+	}
+	if b.existed {
+		// ifupdown only runs the commands in the stanza when bringing the
+		// interface up
+		_, err := b.options.Runner.Run(nil, "ifdown", b.options.InterfaceName)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := b.options.Runner.Run(nil, "ifup", b.options.InterfaceName)
+	if err != nil {
+		return err
+	}
+	err = b.options.verify(b.config)
+	if err != nil {
+		return err
+	}
+	b.changed = false
+	return nil
+}
+
+func (b *ifupdownBackend) Rollback() error {
+	if interfaceExists(b.options.InterfaceName) {
+		b.options.Runner.Run(nil, "ifdown", b.options.InterfaceName)
+	}
+	err := b.files.rollback()
+	if err != nil {
+		return err
+	}
+	b.changed = false
+	if b.existed {
+		_, err = b.options.Runner.Run(nil, "ifup", b.options.InterfaceName)
+		return err
+	}
+	return nil
+}
+
+func (b *ifupdownBackend) Remove() error {
+	_, err := b.options.Runner.Run(nil, "ifdown", b.options.InterfaceName)
+	if err != nil {
+		return err
+	}
+	return removeFiles(b.options.ConfigPath, b.options.WireGuardConfigPath)
+}
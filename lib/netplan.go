@@ -0,0 +1,193 @@
+package lib
+
+func init() {
+	RegisterBackend("netplan", newNetplanBackend)
+}
+
+// netplan cannot express inverted rules, so full-tunnel uses a rule sending
+// packets marked by WireGuard to the main table instead. Nor can it express
+// suppress_prefixlength, so unlike the other backends, more specific routes in
+// the main table, such as the local network, are not used in full-tunnel
+const netplanTemplate = `# WireGuard {{.InterfaceName}} generated with wireguard-negotiator
+network:
+  version: 2
+  tunnels:
+    {{.InterfaceName}}:
+      mode: wireguard
+      key: {{quote .PrivateKey}}
+{{- if .ListenPort}}
+      port: {{.ListenPort}}
+{{- end}}
+{{- if .FullTunnel}}
+      mark: {{fullTunnelMark}}
+{{- end}}
+{{- if .MTU}}
+      mtu: {{.MTU}}
+{{- end}}
+      addresses:
+{{- range .InterfaceIPs}}
+        - {{quote .}}
+{{- end}}
+{{- if or .DNS .DNSSearch}}
+      nameservers:
+{{- if .DNS}}
+        addresses:
+{{- range .DNS}}
+          - {{quote .}}
+{{- end}}
+{{- end}}
+{{- if .DNSSearch}}
+        search:
+{{- range .DNSSearch}}
+          - {{quote .}}
+{{- end}}
+{{- end}}
+{{- end}}
+{{- if .Routes}}
+      routes:
+{{- range .Routes}}
+        - to: {{quote .}}
+          scope: link
+{{- if isDefaultRoute .}}
+          table: {{fullTunnelTable}}
+{{- end}}
+{{- end}}
+{{- end}}
+{{- if .FullTunnel}}
+      routing-policy:
+{{- range $i, $to := defaultRoutes}}
+        - to: {{quote $to}}
+          mark: {{fullTunnelMark}}
+          table: 254
+          priority: 32763
+        - to: {{quote $to}}
+          table: {{fullTunnelTable}}
+          priority: 32764
+{{- end}}
+{{- end}}
+      peers:
+        - keys:
+            public: {{quote .PublicKey}}
+{{- if .PresharedKey}}
+            shared: {{quote .PresharedKey}}
+{{- end}}
+          allowed-ips:
+{{- range .AllowedIPs}}
+            - {{quote .}}
+{{- end}}
+          endpoint: {{quote .Endpoint}}
+          keepalive: {{.PersistentKeepalive}}
+{{- range .Peers}}
+        - keys:
+            public: {{quote .PublicKey}}
+          allowed-ips:
+{{- range .AllowedIPs}}
+            - {{quote .}}
+{{- end}}
+{{- if .Endpoint}}
+          endpoint: {{quote .Endpoint}}
+{{- end}}
+{{- if .PersistentKeepalive}}
+          keepalive: {{.PersistentKeepalive}}
+{{- end}}
+{{- end}}
+`
+
+// netplanBackend writes a netplan configuration file
+type netplanBackend struct {
+	options BackendOptions
+	files   fileSet
+	config  InterfaceAndPeerConfig
+	existed bool
+	changed bool
+}
+
+func newNetplanBackend(options BackendOptions) Backend {
+	if options.ConfigPath == "" {
+		options.ConfigPath = "/etc/netplan/90-" + options.InterfaceName + ".yaml"
+	}
+	return &netplanBackend{options: options}
+}
+
+func (b *netplanBackend) Prepare() error {
+	return checkNotExist(b.options.ConfigPath)
+}
+
+func (b *netplanBackend) Write(config InterfaceAndPeerConfig) error {
+	netplan, err := renderTemplate(b.options.TemplateDir, "netplan", netplanTemplate, config)
+	if err != nil {
+		return err
+	}
+
+	b.files = fileSet{secrets: config.secrets()}
+	b.config = config
+	b.existed = interfaceExists(b.options.InterfaceName)
+	// netplan warns about configuration readable by other users
+	b.files.stage(b.options.ConfigPath, netplan, 0600)
+	changed, err := b.files.commit()
+	if err != nil {
+		return err
+	}
+	b.changed = b.changed || changed
+	return nil
+}
+
+// Apply runs netplan apply. Like networkd, which renders netplan configuration,
+// keys and peers of existing interfaces are also applied directly
+func (b *netplanBackend) Apply() error {
+	if !b.changed {
+		return nil
+	}
+	if b.existed {
+		wgConfig, err := b.config.DeviceConfig()
+		if err != nil {
+			return err
+		}
+		err = b.options.Device.ConfigureDevice(b.options.InterfaceName, wgConfig)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := b.options.Runner.Run(nil, "netplan", "apply")
+	if err != nil {
+		return err
+	}
+	err = b.options.verify(b.config)
+	if err != nil {
+		return err
+	}
+	b.changed = false
+	return nil
+}
+
+func (b *netplanBackend) Rollback() error {
+	err := b.files.rollback()
+	if err != nil {
+		return err
+	}
+	b.changed = false
+	_, err = b.options.Runner.Run(nil, "netplan", "apply")
+	if err != nil {
+		return err
+	}
+	if !b.existed && interfaceExists(b.options.InterfaceName) {
+		_, err = b.options.Runner.Run(nil, "ip", "link", "delete", b.options.InterfaceName)
+	}
+	return err
+}
+
+func (b *netplanBackend) Remove() error {
+	err := removeFiles(b.options.ConfigPath)
+	if err != nil {
+		return err
+	}
+	_, err = b.options.Runner.Run(nil, "netplan", "apply")
+	if err != nil {
+		return err
+	}
+	// netplan does not remove virtual interfaces that are no longer configured
+	if interfaceExists(b.options.InterfaceName) {
+		_, err = b.options.Runner.Run(nil, "ip", "link", "delete", b.options.InterfaceName)
+	}
+	return err
+}
@@ -0,0 +1,248 @@
+package lib
+
+func init() {
+	RegisterBackend("networkd", newNetworkdBackend)
+}
+
+const networkdNetdevTemplate = `
+[NetDev]
+Name = {{.InterfaceName}}
+Kind = wireguard
+Description = WireGuard {{.InterfaceName}} generated with wireguard-negotiator
+
+[WireGuard]
+PrivateKeyFile = {{.PrivateKeyFile}}
+{{if .ListenPort}}
+ListenPort = {{.ListenPort}}
+{{end}}
+{{if .FullTunnel}}
+FirewallMark = {{fullTunnelMark}}
+{{end}}
+
+[WireGuardPeer]
+PublicKey = {{.PublicKey}}
+{{if .PresharedKeyFile}}
+PresharedKeyFile = {{.PresharedKeyFile}}
+{{end}}
+AllowedIPs = {{range $i, $a := .AllowedIPs}}{{if gt $i 0}}, {{end}}{{.}}{{end}}
+Endpoint = {{.Endpoint}}
+PersistentKeepalive = {{.PersistentKeepalive}}
+{{range $i, $p := .Peers}}
+[WireGuardPeer]
+PublicKey = {{.PublicKey}}
+AllowedIPs = {{join .AllowedIPs ", "}}
+{{if .Endpoint}}
+Endpoint = {{.Endpoint}}
+{{end}}
+{{if .PersistentKeepalive}}
+PersistentKeepalive = {{.PersistentKeepalive}}
+{{end}}
+{{end}}
+`
+
+const networkdNetworkTemplate = `
+[Match]
+Name = {{.InterfaceName}}
+
+{{if .MTU}}
+[Link]
+MTUBytes = {{.MTU}}
+{{end}}
+
+[Network]
+{{range $i, $a := .InterfaceIPs}}
+Address = {{.}}
+{{end}}
+{{range $i, $a := .DNS}}
+DNS = {{.}}
+{{end}}
+{{if .DNSSearch}}
+Domains = {{join .DNSSearch " "}}
+{{end}}
+{{if .DelegatedPrefixes}}
+IPForward = yes
+{{end}}
+
+{{range $i, $a := .Routes}}
+[Route]
+Destination = {{.}}
+{{if isDefaultRoute .}}
+Table = {{fullTunnelTable}}
+{{end}}
+{{end}}
+
+{{if .FullTunnel}}
+# Route everything not marked by WireGuard through the tunnel table, while
+# keeping more specific routes in the main table such as the endpoint route
+[RoutingPolicyRule]
+Family = both
+FirewallMark = {{fullTunnelMark}}
+InvertRule = yes
+Table = {{fullTunnelTable}}
+Priority = 32764
+
+[RoutingPolicyRule]
+Family = both
+Table = main
+SuppressPrefixLength = 0
+Priority = 32763
+{{end}}
+`
+
+// networkdGroup is the group of networkd, which reads the key files
+const networkdGroup = "systemd-network"
+
+// networkdConfig adds the paths of key files, so that keys are not written
+// into the world-readable netdev file
+type networkdConfig struct {
+	InterfaceAndPeerConfig
+	PrivateKeyFile   string
+	PresharedKeyFile string
+}
+
+func renderNetworkd(templateDir string, config networkdConfig) ([]byte, []byte, error) {
+	netdev, err := renderTemplate(templateDir, "netdev", networkdNetdevTemplate, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	network, err := renderTemplate(templateDir, "network", networkdNetworkTemplate, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return netdev, network, nil
+}
+
+// networkdBackend writes .netdev and .network files for systemd-networkd
+type networkdBackend struct {
+	options BackendOptions
+	files   fileSet
+	config  InterfaceAndPeerConfig
+	// Whether the interface existed before Write
+	existed bool
+	// Whether files were written but not yet applied
+	changed bool
+}
+
+func newNetworkdBackend(options BackendOptions) Backend {
+	if options.ConfigPath == "" {
+		options.ConfigPath = "/etc/systemd/network/" + options.InterfaceName
+	}
+	return &networkdBackend{options: options}
+}
+
+func (b *networkdBackend) netdevPath() string {
+	return b.options.ConfigPath + ".netdev"
+}
+
+func (b *networkdBackend) networkPath() string {
+	return b.options.ConfigPath + ".network"
+}
+
+func (b *networkdBackend) keyPath() string {
+	return b.options.ConfigPath + ".key"
+}
+
+func (b *networkdBackend) pskPath() string {
+	return b.options.ConfigPath + ".psk"
+}
+
+func (b *networkdBackend) Prepare() error {
+	return checkNotExist(b.netdevPath(), b.networkPath(), b.keyPath())
+}
+
+func (b *networkdBackend) Write(config InterfaceAndPeerConfig) error {
+	data := networkdConfig{
+		InterfaceAndPeerConfig: config,
+		PrivateKeyFile:         b.keyPath(),
+	}
+	if len(config.PresharedKey) > 0 {
+		data.PresharedKeyFile = b.pskPath()
+	}
+	netdev, network, err := renderNetworkd(b.options.TemplateDir, data)
+	if err != nil {
+		return err
+	}
+
+	b.files = fileSet{secrets: config.secrets()}
+	b.config = config
+	b.existed = interfaceExists(b.options.InterfaceName)
+	b.files.stageGroup(b.keyPath(), []byte(config.PrivateKey+"\n"), 0640, networkdGroup)
+	if len(config.PresharedKey) > 0 {
+		b.files.stageGroup(b.pskPath(), []byte(config.PresharedKey+"\n"), 0640, networkdGroup)
+	}
+	b.files.stage(b.netdevPath(), netdev, 0644)
+	b.files.stage(b.networkPath(), network, 0644)
+	changed, err := b.files.commit()
+	if err != nil {
+		return err
+	}
+	b.changed = b.changed || changed
+	return nil
+}
+
+// Apply restarts networkd. The files are not reread by networkd for existing
+// WireGuard interfaces, so keys and peers are also applied directly to the
+// interface
+func (b *networkdBackend) Apply() error {
+	if !b.changed {
+		return nil
+	}
+	if b.existed {
+		wgConfig, err := b.config.DeviceConfig()
+		if err != nil {
+			return err
+		}
+		err = b.options.Device.ConfigureDevice(b.options.InterfaceName, wgConfig)
+		if err != nil {
+			return err
+		}
+	}
+	err := b.restart()
+	if err != nil {
+		return err
+	}
+	err = b.options.verify(b.config)
+	if err != nil {
+		return err
+	}
+	b.changed = false
+	return nil
+}
+
+func (b *networkdBackend) Rollback() error {
+	err := b.files.rollback()
+	if err != nil {
+		return err
+	}
+	b.changed = false
+	if !b.existed && interfaceExists(b.options.InterfaceName) {
+		// networkd does not remove interfaces that are no longer configured
+		_, err = b.options.Runner.Run(nil, "ip", "link", "delete", b.options.InterfaceName)
+		if err != nil {
+			return err
+		}
+	}
+	return b.restart()
+}
+
+func (b *networkdBackend) Remove() error {
+	err := removeFiles(b.netdevPath(), b.networkPath(), b.keyPath(), b.pskPath())
+	if err != nil {
+		return err
+	}
+
+	// networkd does not remove interfaces that are no longer configured
+	if interfaceExists(b.options.InterfaceName) {
+		_, err = b.options.Runner.Run(nil, "ip", "link", "delete", b.options.InterfaceName)
+		if err != nil {
+			return err
+		}
+	}
+	return b.restart()
+}
+
+func (b *networkdBackend) restart() error {
+	// For now, simply run one fixed command to reread from the config file
+	_, err := b.options.Runner.Run(nil, "systemctl", "restart", "systemd-networkd")
+	return err
+}
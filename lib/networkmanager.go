@@ -0,0 +1,165 @@
+package lib
+
+func init() {
+	RegisterBackend("networkmanager", newNetworkManagerBackend)
+}
+
+const networkManagerTemplate = `[connection]
+id={{.InterfaceName}}
+type=wireguard
+interface-name={{.InterfaceName}}
+
+[wireguard]
+private-key={{.PrivateKey}}
+{{- if .ListenPort}}
+listen-port={{.ListenPort}}
+{{- end}}
+{{- if .MTU}}
+mtu={{.MTU}}
+{{- end}}
+{{- if .FullTunnel}}
+fwmark={{fullTunnelMark}}
+ip4-auto-default-route=1
+ip6-auto-default-route=1
+{{- end}}
+
+[wireguard-peer.{{.PublicKey}}]
+{{- if .PresharedKey}}
+preshared-key={{.PresharedKey}}
+preshared-key-flags=0
+{{- end}}
+endpoint={{.Endpoint}}
+persistent-keepalive={{.PersistentKeepalive}}
+allowed-ips={{range .AllowedIPs}}{{.}};{{end}}
+{{range .Peers}}
+[wireguard-peer.{{.PublicKey}}]
+{{- if .Endpoint}}
+endpoint={{.Endpoint}}
+{{- end}}
+{{- if .PersistentKeepalive}}
+persistent-keepalive={{.PersistentKeepalive}}
+{{- end}}
+allowed-ips={{range .AllowedIPs}}{{.}};{{end}}
+{{end}}
+[ipv4]
+{{- with ipv4 .InterfaceIPs}}
+method=manual
+{{- range $i, $a := .}}
+address{{add1 $i}}={{.}}
+{{- end}}
+{{- else}}
+method=disabled
+{{- end}}
+{{- with ipv4 .DNS}}
+dns={{range .}}{{.}};{{end}}
+{{- end}}
+{{- if .DNSSearch}}
+dns-search={{range .DNSSearch}}{{.}};{{end}}
+{{- end}}
+{{- range $i, $a := withoutDefaultRoutes (ipv4 .Routes)}}
+route{{add1 $i}}={{.}}
+{{- end}}
+
+[ipv6]
+{{- with ipv6 .InterfaceIPs}}
+method=manual
+{{- range $i, $a := .}}
+address{{add1 $i}}={{.}}
+{{- end}}
+{{- else}}
+method=ignore
+{{- end}}
+{{- with ipv6 .DNS}}
+dns={{range .}}{{.}};{{end}}
+{{- end}}
+{{- range $i, $a := withoutDefaultRoutes (ipv6 .Routes)}}
+route{{add1 $i}}={{.}}
+{{- end}}
+`
+
+// networkManagerBackend writes a NetworkManager connection keyfile
+type networkManagerBackend struct {
+	options BackendOptions
+	files   fileSet
+	config  InterfaceAndPeerConfig
+	changed bool
+}
+
+func newNetworkManagerBackend(options BackendOptions) Backend {
+	if options.ConfigPath == "" {
+		options.ConfigPath = "/etc/NetworkManager/system-connections/" + options.InterfaceName + ".nmconnection"
+	}
+	return &networkManagerBackend{options: options}
+}
+
+func (b *networkManagerBackend) Prepare() error {
+	return checkNotExist(b.options.ConfigPath)
+}
+
+func (b *networkManagerBackend) Write(config InterfaceAndPeerConfig) error {
+	connection, err := renderTemplate(b.options.TemplateDir, "networkmanager", networkManagerTemplate, config)
+	if err != nil {
+		return err
+	}
+
+	b.files = fileSet{secrets: config.secrets()}
+	b.config = config
+	// NetworkManager ignores connection files readable by other users
+	b.files.stage(b.options.ConfigPath, connection, 0600)
+	changed, err := b.files.commit()
+	if err != nil {
+		return err
+	}
+	b.changed = b.changed || changed
+	return nil
+}
+
+func (b *networkManagerBackend) Apply() error {
+	if !b.changed {
+		return nil
+	}
+	err := b.up()
+	if err != nil {
+		return err
+	}
+	err = b.options.verify(b.config)
+	if err != nil {
+		return err
+	}
+	b.changed = false
+	return nil
+}
+
+func (b *networkManagerBackend) Rollback() error {
+	created := b.files.created(b.options.ConfigPath)
+	err := b.files.rollback()
+	if err != nil {
+		return err
+	}
+	b.changed = false
+	if created {
+		// The connection may not have been loaded yet
+		b.options.Runner.Run(nil, "nmcli", "connection", "delete", b.options.InterfaceName)
+		return nil
+	}
+	return b.up()
+}
+
+func (b *networkManagerBackend) Remove() error {
+	// Deleting the connection also deletes the keyfile
+	_, err := b.options.Runner.Run(nil, "nmcli", "connection", "delete", b.options.InterfaceName)
+	if err != nil {
+		return err
+	}
+	return removeFiles(b.options.ConfigPath)
+}
+
+func (b *networkManagerBackend) up() error {
+	// NetworkManager does not watch for new connection files by default
+	_, err := b.options.Runner.Run(nil, "nmcli", "connection", "load", b.options.ConfigPath)
+	if err != nil {
+		return err
+	}
+	_, err = b.options.Runner.Run(nil, "nmcli", "connection", "up", b.options.InterfaceName)
+	return err
+}
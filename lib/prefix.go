@@ -0,0 +1,162 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+var (
+	ErrPrefixLength        = fmt.Errorf("prefix length not valid for delegation pool")
+	ErrPrefixOutsidePool   = fmt.Errorf("prefix is not within a delegation pool")
+	ErrPrefixOverlaps      = fmt.Errorf("prefix overlaps with an existing prefix")
+	ErrPrefixPoolExhausted = fmt.Errorf("no free prefix left in delegation pools")
+	ErrAddressExhausted    = fmt.Errorf("no free address left in the interface network")
+)
+
+// PrefixOverlaps reports whether two prefixes share any address
+func PrefixOverlaps(a, b net.IPNet) bool {
+	a = normalizePrefix(a)
+	b = normalizePrefix(b)
+	if len(a.IP) != len(b.IP) {
+		return false
+	}
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+// PrefixContains reports whether inner lies entirely within outer
+func PrefixContains(outer, inner net.IPNet) bool {
+	outer = normalizePrefix(outer)
+	inner = normalizePrefix(inner)
+	if len(outer.IP) != len(inner.IP) {
+		return false
+	}
+	outerOnes, _ := outer.Mask.Size()
+	innerOnes, _ := inner.Mask.Size()
+	return outerOnes <= innerOnes && outer.Contains(inner.IP)
+}
+
+// ValidatePrefix checks that an advertised prefix is within one of the pools
+// and does not overlap any of the used prefixes
+func ValidatePrefix(pools []net.IPNet, prefix net.IPNet, used []net.IPNet) error {
+	within := false
+	for _, pool := range pools {
+		if PrefixContains(pool, prefix) {
+			within = true
+			break
+		}
+	}
+	if !within {
+		return fmt.Errorf("%w: %v", ErrPrefixOutsidePool, prefix.String())
+	}
+	for _, u := range used {
+		if PrefixOverlaps(prefix, u) {
+			return fmt.Errorf("%w: %v overlaps %v", ErrPrefixOverlaps, prefix.String(), u.String())
+		}
+	}
+	return nil
+}
+
+// AllocatePrefix returns the first prefix of the given length from the pools
+// that does not overlap any of the used prefixes
+func AllocatePrefix(pools []net.IPNet, length int, used []net.IPNet) (net.IPNet, error) {
+	validLength := false
+	for _, pool := range pools {
+		pool = normalizePrefix(pool)
+		ones, bits := pool.Mask.Size()
+		if length < ones || length > bits {
+			continue
+		}
+		validLength = true
+
+		candidate := net.IPNet{
+			IP:   pool.IP.Mask(pool.Mask),
+			Mask: net.CIDRMask(length, bits),
+		}
+		for pool.Contains(candidate.IP) {
+			free := true
+			for _, u := range used {
+				if PrefixOverlaps(candidate, u) {
+					free = false
+					break
+				}
+			}
+			if free {
+				return candidate, nil
+			}
+
+			next, overflow := nextPrefix(candidate)
+			if overflow {
+				break
+			}
+			candidate = next
+		}
+	}
+	if !validLength {
+		return net.IPNet{}, fmt.Errorf("%w: /%d", ErrPrefixLength, length)
+	}
+	return net.IPNet{}, ErrPrefixPoolExhausted
+}
+
+// AllocateAddress returns the first host address in the network that is not
+// within any of the used prefixes. The network address, and the broadcast
+// address of IPv4 networks, are never allocated
+func AllocateAddress(network net.IPNet, used []net.IPNet) (net.IP, error) {
+	network = normalizePrefix(network)
+	ones, bits := network.Mask.Size()
+	hostMask := net.CIDRMask(bits, bits)
+
+	reserved := append([]net.IPNet{{IP: network.IP, Mask: hostMask}}, used...)
+	if bits == 8*net.IPv4len && ones < bits-1 {
+		broadcast := make(net.IP, len(network.IP))
+		for i := range broadcast {
+			broadcast[i] = network.IP[i] | ^network.Mask[i]
+		}
+		reserved = append(reserved, net.IPNet{IP: broadcast, Mask: hostMask})
+	}
+
+	host, err := AllocatePrefix([]net.IPNet{network}, bits, reserved)
+	if errors.Is(err, ErrPrefixPoolExhausted) {
+		return nil, ErrAddressExhausted
+	}
+	if err != nil {
+		return nil, err
+	}
+	return host.IP, nil
+}
+
+// nextPrefix returns the prefix of the same length directly after the given
+// prefix
+func nextPrefix(prefix net.IPNet) (net.IPNet, bool) {
+	ones, bits := prefix.Mask.Size()
+	result := make(net.IP, len(prefix.IP))
+	copy(result, prefix.IP)
+
+	// Add one at the last bit of the network part
+	bit := bits - ones
+	i := len(result) - 1 - bit/8
+	carry := 1 << uint(bit%8)
+	for ; i >= 0 && carry > 0; i-- {
+		sum := int(result[i]) + carry
+		result[i] = byte(sum)
+		carry = sum >> 8
+	}
+
+	return net.IPNet{
+		IP:   result,
+		Mask: prefix.Mask,
+	}, carry > 0
+}
+
+// normalizePrefix ensures that IPv4 prefixes use the 4-byte representation
+// and that the address is the network address
+func normalizePrefix(prefix net.IPNet) net.IPNet {
+	ip := prefix.IP
+	if ip4 := ip.To4(); ip4 != nil && len(prefix.Mask) == net.IPv4len {
+		ip = ip4
+	}
+	return net.IPNet{
+		IP:   ip.Mask(prefix.Mask),
+		Mask: prefix.Mask,
+	}
+}
@@ -0,0 +1,106 @@
+package lib
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func mustParseCIDR(s string) net.IPNet {
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return *ipNet
+}
+
+func TestAllocatePrefix(t *testing.T) {
+	pools := []net.IPNet{
+		mustParseCIDR("10.100.0.0/24"),
+		mustParseCIDR("2001:db8:100::/48"),
+	}
+	used := []net.IPNet{
+		mustParseCIDR("10.100.0.0/29"),
+		mustParseCIDR("10.100.0.10/32"),
+		mustParseCIDR("2001:db8:100::/64"),
+	}
+
+	got, err := AllocatePrefix(pools, 29, used)
+	if err != nil {
+		t.Fatalf("allocate failed: %v", err)
+	}
+	if want := "10.100.0.16/29"; got.String() != want {
+		t.Fatalf("allocated %v, want %v", got.String(), want)
+	}
+
+	got, err = AllocatePrefix(pools, 64, used)
+	if err != nil {
+		t.Fatalf("allocate failed: %v", err)
+	}
+	if want := "2001:db8:100:1::/64"; got.String() != want {
+		t.Fatalf("allocated %v, want %v", got.String(), want)
+	}
+
+	_, err = AllocatePrefix(pools, 16, used)
+	if !errors.Is(err, ErrPrefixLength) {
+		t.Fatalf("allocate error %v, want %v", err, ErrPrefixLength)
+	}
+
+	full := []net.IPNet{mustParseCIDR("10.100.0.0/24")}
+	_, err = AllocatePrefix(pools[:1], 30, full)
+	if !errors.Is(err, ErrPrefixPoolExhausted) {
+		t.Fatalf("allocate error %v, want %v", err, ErrPrefixPoolExhausted)
+	}
+}
+
+func TestValidatePrefix(t *testing.T) {
+	pools := []net.IPNet{mustParseCIDR("10.100.0.0/24")}
+	used := []net.IPNet{mustParseCIDR("10.100.0.8/29")}
+
+	err := ValidatePrefix(pools, mustParseCIDR("10.100.0.0/29"), used)
+	if err != nil {
+		t.Fatalf("validate failed: %v", err)
+	}
+
+	err = ValidatePrefix(pools, mustParseCIDR("10.100.0.0/28"), used)
+	if !errors.Is(err, ErrPrefixOverlaps) {
+		t.Fatalf("validate error %v, want %v", err, ErrPrefixOverlaps)
+	}
+
+	err = ValidatePrefix(pools, mustParseCIDR("10.101.0.0/29"), used)
+	if !errors.Is(err, ErrPrefixOutsidePool) {
+		t.Fatalf("validate error %v, want %v", err, ErrPrefixOutsidePool)
+	}
+}
+
+func TestAllocateAddress(t *testing.T) {
+	network := mustParseCIDR("10.0.0.0/29")
+	used := []net.IPNet{
+		mustParseCIDR("10.0.0.1/32"),
+		mustParseCIDR("10.0.0.2/32"),
+		mustParseCIDR("10.0.0.4/32"),
+	}
+
+	// Addresses freed by peers that left are allocated again
+	got, err := AllocateAddress(network, used)
+	if err != nil {
+		t.Fatalf("allocate failed: %v", err)
+	}
+	if want := "10.0.0.3"; got.String() != want {
+		t.Fatalf("allocated %v, want %v", got.String(), want)
+	}
+
+	used = append(used, mustParseCIDR("10.0.0.3/32"), mustParseCIDR("10.0.0.5/32"), mustParseCIDR("10.0.0.6/32"))
+	_, err = AllocateAddress(network, used)
+	if !errors.Is(err, ErrAddressExhausted) {
+		t.Fatalf("got error %v, want %v", err, ErrAddressExhausted)
+	}
+
+	got, err = AllocateAddress(mustParseCIDR("2001:db8::/64"), []net.IPNet{mustParseCIDR("2001:db8::1/128")})
+	if err != nil {
+		t.Fatalf("allocate failed: %v", err)
+	}
+	if want := "2001:db8::2"; got.String() != want {
+		t.Fatalf("allocated %v, want %v", got.String(), want)
+	}
+}
@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// Reconcile modes decide what happens when the peers in the config and on the
+// interface differ
+const (
+	// ReconcileLog only logs the differences
+	ReconcileLog = "log"
+	// ReconcileDevice converges the interface to the config, adding missing
+	// peers and removing peers that are not in the config
+	ReconcileDevice = "device"
+	// ReconcileConfig converges the config to the interface, adopting peers
+	// added with wg set. Peers missing on the interface are kept in the config,
+	// as the interface is empty after a reboot
+	ReconcileConfig = "config"
+)
+
+// drift lists the differences between the config and the interface
+type drift struct {
+	// Peers in the config that are not on the interface, such as after a
+	// reboot
+	missing []wgtypes.PeerConfig
+	// Peers on the interface that are not in the config, such as peers added
+	// with wg set
+	unknown []wgtypes.Peer
+	// Peers with different allowed IPs or preshared keys, as in the config and
+	// as on the interface
+	changed     []wgtypes.PeerConfig
+	changedLive []wgtypes.Peer
+	// Whether the private key or listen port differ
+	interfaceChanged bool
+}
+
+func (d drift) empty() bool {
+	return len(d.missing) == 0 && len(d.unknown) == 0 && len(d.changed) == 0 && !d.interfaceChanged
+}
+
+// log writes the differences to the log
+func (d drift) log(name string) {
+	if d.interfaceChanged {
+		log.Printf("WARNING: Private key or listen port of %v differ from the config\n", name)
+	}
+	for _, peer := range d.missing {
+		log.Printf("WARNING: Peer %v is in the config but not on %v\n", peer.PublicKey, name)
+	}
+	for _, peer := range d.unknown {
+		log.Printf("WARNING: Peer %v is on %v but not in the config\n", peer.PublicKey, name)
+	}
+	for _, peer := range d.changed {
+		log.Printf("WARNING: Peer %v on %v differs from the config\n", peer.PublicKey, name)
+	}
+}
+
+// configRead reads the config, ready to be applied with ReplacePeers
+func configRead(config string) (wgtypes.Config, error) {
+	f, err := os.Open(config)
+	if err != nil {
+		return wgtypes.Config{}, fmt.Errorf("opening %s failed: %w", config, err)
+	}
+	defer f.Close()
+
+	wgConfig, _, err := ReadConfig(f)
+	if err != nil {
+		return wgtypes.Config{}, fmt.Errorf("reading %s failed: %w", config, err)
+	}
+	return wgConfig, nil
+}
+
+// diffDevice compares the config with the interface. Endpoints are not
+// compared, as they change when peers roam
+func diffDevice(wgConfig wgtypes.Config, device *wgtypes.Device) drift {
+	var d drift
+	if wgConfig.PrivateKey != nil && *wgConfig.PrivateKey != device.PrivateKey {
+		d.interfaceChanged = true
+	}
+	if wgConfig.ListenPort != nil && *wgConfig.ListenPort != device.ListenPort {
+		d.interfaceChanged = true
+	}
+
+	live := make(map[wgtypes.Key]wgtypes.Peer)
+	for _, peer := range device.Peers {
+		live[peer.PublicKey] = peer
+	}
+	for _, peer := range wgConfig.Peers {
+		livePeer, found := live[peer.PublicKey]
+		delete(live, peer.PublicKey)
+		if !found {
+			d.missing = append(d.missing, peer)
+			continue
+		}
+		var presharedKey wgtypes.Key
+		if peer.PresharedKey != nil {
+			presharedKey = *peer.PresharedKey
+		}
+		if presharedKey != livePeer.PresharedKey || !sameIPNets(peer.AllowedIPs, livePeer.AllowedIPs) {
+			d.changed = append(d.changed, peer)
+			d.changedLive = append(d.changedLive, livePeer)
+		}
+	}
+	for _, peer := range device.Peers {
+		if _, unknown := live[peer.PublicKey]; unknown {
+			d.unknown = append(d.unknown, peer)
+		}
+	}
+	return d
+}
+
+// sameIPNets reports whether both lists contain the same networks, in any
+// order
+func sameIPNets(a []net.IPNet, b []net.IPNet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	sorted := func(ipNets []net.IPNet) []string {
+		s := make([]string, len(ipNets))
+		for i, ipNet := range ipNets {
+			s[i] = ipNet.String()
+		}
+		sort.Strings(s)
+		return s
+	}
+	sa, sb := sorted(a), sorted(b)
+	for i := range sa {
+		if sa[i] != sb[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// convergeDevice changes the interface to match the config
+func convergeDevice(device Device, wgConfig wgtypes.Config, d drift) error {
+	if d.interfaceChanged {
+		err := device.Configure(wgtypes.Config{
+			PrivateKey: wgConfig.PrivateKey,
+			ListenPort: wgConfig.ListenPort,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, peer := range append(d.missing, d.changed...) {
+		err := device.AddPeer(peer)
+		if err != nil {
+			return err
+		}
+	}
+	for _, peer := range d.unknown {
+		err := device.RemovePeer(peer.PublicKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// convergeConfig adds and updates peers in the config to match the
+// interface. Peers missing on the interface are never removed, as the
+// interface may have lost them, such as after a reboot. The private key and
+// listen port are left, as clients depend on them
+func convergeConfig(config string, d drift) error {
+	for _, peer := range d.changedLive {
+		err := configUpdatePeer(config, peer)
+		if err != nil {
+			return err
+		}
+	}
+	for _, peer := range d.unknown {
+		err := configAppendPeer(config, peer)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1035 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var (
+	ErrNoAddressesFound = fmt.Errorf("no address found on the interface")
+	ErrPeerNotFound     = fmt.Errorf("peer not found in the config")
+	ErrPeerExists       = fmt.Errorf("peer already exists in the config")
+	ErrShuttingDown     = fmt.Errorf("server is shutting down")
+	ErrTooManyPending   = fmt.Errorf("too many requests waiting for the gate")
+	ErrReconcileMode    = fmt.Errorf("unknown reconcile mode")
+	ErrMeshDisabled     = fmt.Errorf("mesh mode is not enabled")
+)
+
+// shutdownTimeout is how long Run waits for in-flight requests
+const shutdownTimeout = 30 * time.Second
+
+// retryAfter is the Retry-After header value of responses while shutting down
+const retryAfter = "10"
+
+// ServerOptions configures a Server. A nil Gate approves every request, and a
+// nil Store keeps requests in memory only. A nil Device or Allocator is
+// replaced with one that acts on the system and the config
+type ServerOptions struct {
+	InterfaceName string
+	// Path to the WireGuard configuration file, which is the database of
+	// peers. Empty is /etc/wireguard/<interface>.conf
+	ConfigPath string
+	// Endpoint address of the server given to clients
+	Endpoint string
+	// Address Run listens on. Clients are given the URL of /ping through the
+	// tunnel if the server listens on the tunnel address
+	Listen string
+	// Pools of routed prefixes delegated to clients
+	DelegationPools []net.IPNet
+	// Configuration pushed to clients. Routes are in CIDR notation
+	Routes    []string
+	DNS       []string
+	DNSSearch []string
+	MTU       int
+	// Return every other peer to clients, so that clients configure direct
+	// tunnels to each other
+	Mesh bool
+	// How long requests may stay pending. Zero keeps requests pending until
+	// decided
+	PendingTTL time.Duration
+	// Generate a preshared key for each new peer
+	PresharedKeys bool
+	// Serve the running binary upon GET request to /
+	ServeBinary bool
+	// Apply the config to the interface on start, equivalent to wg setconf
+	ApplyOnStart bool
+	// How often the config is compared with the interface. Zero disables
+	// reconciling
+	ReconcileInterval time.Duration
+	// What happens when the config and the interface differ, one of
+	// ReconcileLog, ReconcileDevice or ReconcileConfig. Empty is ReconcileLog
+	Reconcile string
+
+	Gate      Gate
+	Allocator Allocator
+	Store     Store
+	Device    Device
+}
+
+// Server negotiates peers for a WireGuard interface over HTTP. It is an
+// http.Handler, so that it can be embedded in other servers, which must call
+// Shutdown when they stop
+type Server struct {
+	options     ServerOptions
+	mux         *http.ServeMux
+	device      Device
+	privateKey  wgtypes.Key
+	interfIP    net.IP
+	interfIPNet *net.IPNet
+	pingURL     string
+
+	allocator   Allocator
+	delegator   *delegator
+	enrollments *enrollments
+	enroller    *enroller
+	versioner   *versioner
+	// Serializes changes to the config file
+	configLock sync.Mutex
+}
+
+// NewServer reads the interface and the config, and starts gating requests
+// that were pending before a restart
+func NewServer(options ServerOptions) (*Server, error) {
+	if options.ConfigPath == "" {
+		options.ConfigPath = "/etc/wireguard/" + options.InterfaceName + ".conf"
+	}
+	if options.Gate == nil {
+		options.Gate = AllowAll
+	}
+	if options.Device == nil {
+		options.Device = WgctrlDevice{Name: options.InterfaceName}
+	}
+
+	// Validate pushed configuration
+	var routes []string
+	for _, route := range options.Routes {
+		_, routeIPNet, err := net.ParseCIDR(route)
+		if err != nil {
+			return nil, fmt.Errorf("route %v not valid: %w", route, err)
+		}
+		routes = append(routes, routeIPNet.String())
+	}
+	options.Routes = routes
+	for _, d := range options.DNS {
+		if net.ParseIP(d) == nil {
+			return nil, fmt.Errorf("%w: DNS server %v", ErrValueParse, d)
+		}
+	}
+	switch options.Reconcile {
+	case "":
+		options.Reconcile = ReconcileLog
+	case ReconcileLog, ReconcileDevice, ReconcileConfig:
+	default:
+		return nil, fmt.Errorf("%w: %v", ErrReconcileMode, options.Reconcile)
+	}
+
+	s := &Server{
+		options:   options,
+		mux:       http.NewServeMux(),
+		device:    options.Device,
+		versioner: newVersioner(),
+	}
+
+	// Obtain the server's keys
+	var err error
+	s.privateKey, err = configReadInterfacePrivateKey(options.ConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if options.ApplyOnStart {
+		wgConfig, err := configRead(options.ConfigPath)
+		if err != nil {
+			return nil, err
+		}
+		err = s.device.Configure(wgConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Obtain interface address for use in allocation
+	addresses, err := s.device.Addresses()
+	if err != nil {
+		return nil, err
+	}
+	if len(addresses) < 1 {
+		return nil, ErrNoAddressesFound
+	}
+	s.interfIP = addresses[0].IP
+	s.interfIPNet = &net.IPNet{
+		IP:   addresses[0].IP.Mask(addresses[0].Mask),
+		Mask: addresses[0].Mask,
+	}
+	s.pingURL = tunnelPingURL(options.Listen, s.interfIP)
+
+	s.allocator = options.Allocator
+	if s.allocator == nil {
+		s.allocator = &configAllocator{
+			network:  *s.interfIPNet,
+			config:   options.ConfigPath,
+			reserved: []net.IPNet{ipToIPNetWithHostMask(s.interfIP)},
+		}
+	}
+	s.delegator = &delegator{
+		pools:    options.DelegationPools,
+		config:   options.ConfigPath,
+		reserved: []net.IPNet{*s.interfIPNet},
+	}
+	var pending []EnrollmentRequest
+	s.enrollments, pending, err = newEnrollments(options.Store, options.PendingTTL)
+	if err != nil {
+		return nil, err
+	}
+	var regate []EnrollmentRequest
+	for _, req := range pending {
+		// A request may have been added just before the restart
+		publicKey, err := wgtypes.ParseKey(req.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		_, added, err := configReadPeer(options.ConfigPath, publicKey)
+		if err != nil {
+			return nil, err
+		}
+		if added {
+			s.enrollments.finish(req.ID, StatusApproved)
+			continue
+		}
+		s.allocator.Reserve(req.IP)
+		s.delegator.reserve(req.DelegatedPrefixes)
+		regate = append(regate, req)
+	}
+
+	s.enroller = newEnroller(options.Gate, s.enrollments, s.apply, s.finish)
+	s.enroller.start()
+	go s.expire()
+	if options.ReconcileInterval > 0 {
+		go s.reconcileLoop()
+	}
+
+	// Requests pending before a restart are gated again
+	for _, req := range regate {
+		err := s.enroller.submit(req)
+		if err != nil {
+			log.Printf("Request from %v not gated again: %v\n", req.PublicKey, err)
+		}
+	}
+
+	// TODO: Rate limiting
+
+	// Routes are served at the legacy paths and under the /v1/ API, which
+	// encodes request bodies as JSON instead of forms
+	handle := func(pattern string, handler http.HandlerFunc) {
+		s.mux.HandleFunc(pattern, handler)
+		s.mux.HandleFunc("/v1"+pattern, handler)
+	}
+	s.mux.HandleFunc("/v1/info", s.handleInfo)
+	s.mux.HandleFunc("/", s.handleBinary)
+	handle("/ping", s.handlePing)
+	handle("/request", s.handleRequest)
+	// Legacy clients wait for the response to /request instead of polling
+	s.mux.HandleFunc("/v1/request/", s.handleStatus)
+	handle("/sync", s.handleSync)
+	handle("/rotate", s.handleRotate)
+	handle("/leave", s.handleLeave)
+	handle("/endpoints", s.handleEndpoints)
+
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// Run serves HTTP on the listen address until the context is done, then shuts
+// down gracefully
+func (s *Server) Run(ctx context.Context) error {
+	server := &http.Server{
+		Addr:    s.options.Listen,
+		Handler: s,
+	}
+
+	log.Printf("Server listening on %v\n", s.options.Listen)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-serveErr:
+		s.enroller.stop()
+		return err
+	case <-ctx.Done():
+	}
+
+	// Stop taking requests first, so that handlers waiting for decisions
+	// return, then let in-flight handlers and the peer being added finish
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	s.enroller.stop()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		log.Printf("Server shutdown error: %v\n", err)
+	}
+	return s.Shutdown(shutdownCtx)
+}
+
+// Shutdown stops taking requests, so that handlers waiting for decisions
+// return, and waits until a peer that is being added is added. Requests that
+// are not yet added stay pending in the store. Without a store, they are
+// cancelled, as they would be lost on restart
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.enroller.stop()
+	if s.options.Store == nil {
+		for _, req := range s.enrollments.cancelPending() {
+			s.release(req)
+		}
+	}
+	err := s.enroller.wait(ctx)
+	if err != nil {
+		return fmt.Errorf("waiting for peer to be added failed: %w", err)
+	}
+	return nil
+}
+
+// apply adds an approved peer to the config and the interface
+func (s *Server) apply(req EnrollmentRequest) error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	err := configAddPeer(s.options.ConfigPath, req)
+	if err != nil {
+		return err
+	}
+	publicKey, err := wgtypes.ParseKey(req.PublicKey)
+	if err != nil {
+		return err
+	}
+	peer, _, err := configReadPeer(s.options.ConfigPath, publicKey)
+	if err != nil {
+		return err
+	}
+	err = s.device.AddPeer(peer)
+	if err != nil {
+		return err
+	}
+	s.versioner.bump()
+	return nil
+}
+
+// Reservations of requests are released once they are in the config, or
+// when they are rejected or expire
+func (s *Server) release(req EnrollmentRequest) {
+	s.allocator.Release(req.IP)
+	s.delegator.release(req.DelegatedPrefixes)
+}
+
+func (s *Server) finish(req EnrollmentRequest, status string) {
+	if s.enrollments.finish(req.ID, status) {
+		s.release(req)
+	}
+}
+
+// expire releases requests that expired until the server is stopped
+func (s *Server) expire() {
+	ticker := time.NewTicker(expireInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.enroller.stopping:
+			return
+		}
+		for _, req := range s.enrollments.expire() {
+			log.Printf("Request from %v expired\n", req.PublicKey)
+			s.release(req)
+		}
+	}
+}
+
+// Reconcile compares the config with the interface, logs the differences and
+// converges one to the other depending on the reconcile mode
+func (s *Server) Reconcile() error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	wgConfig, err := configRead(s.options.ConfigPath)
+	if err != nil {
+		return err
+	}
+	device, err := s.device.Read()
+	if err != nil {
+		return err
+	}
+	d := diffDevice(wgConfig, device)
+	if d.empty() {
+		return nil
+	}
+	d.log(s.options.InterfaceName)
+
+	switch s.options.Reconcile {
+	case ReconcileDevice:
+		log.Printf("Applying the config to %v\n", s.options.InterfaceName)
+		return convergeDevice(s.device, wgConfig, d)
+	case ReconcileConfig:
+		if len(d.missing) > 0 {
+			log.Printf("WARNING: Peers missing on %v are kept in the config, remove them with leave or by hand\n", s.options.InterfaceName)
+		}
+		// Only peers found on the interface change the config
+		if len(d.unknown) == 0 && len(d.changedLive) == 0 {
+			return nil
+		}
+		log.Printf("Saving the peers of %v into the config\n", s.options.InterfaceName)
+		err = convergeConfig(s.options.ConfigPath, d)
+		if err != nil {
+			return err
+		}
+		s.versioner.bump()
+	}
+	return nil
+}
+
+// reconcileLoop reconciles periodically until the server is stopped
+func (s *Server) reconcileLoop() {
+	ticker := time.NewTicker(s.options.ReconcileInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.enroller.stopping:
+			return
+		}
+		err := s.Reconcile()
+		if err != nil {
+			log.Printf("WARNING: Reconcile failed: %v\n", err)
+		}
+	}
+}
+
+// peerConfig produces configuration for a peer
+func (s *Server) peerConfig(publicKey string, ip net.IP, delegatedPrefixes []net.IPNet) (PeerConfigResponse, error) {
+	ipNet := &net.IPNet{
+		IP:   ip,
+		Mask: s.interfIPNet.Mask,
+	}
+	resp := PeerConfigResponse{
+		InterfaceIPs:        []string{ipNet.String()},
+		AllowedIPs:          append([]string{s.interfIPNet.String()}, s.options.Routes...),
+		PublicKey:           s.privateKey.PublicKey().String(),
+		Endpoint:            s.options.Endpoint,
+		PersistentKeepalive: 25,
+		Routes:              s.options.Routes,
+		DNS:                 s.options.DNS,
+		DNSSearch:           s.options.DNSSearch,
+		MTU:                 s.options.MTU,
+		ServerIP:            s.interfIP.String(),
+		PingURL:             s.pingURL,
+	}
+	for _, prefix := range delegatedPrefixes {
+		resp.DelegatedPrefixes = append(resp.DelegatedPrefixes, prefix.String())
+	}
+	if s.options.Mesh {
+		peers, err := meshPeers(s.device, s.options.ConfigPath, publicKey)
+		if err != nil {
+			return resp, err
+		}
+		resp.Peers = peers
+	}
+	return resp, nil
+}
+
+func (s *Server) handleInfo(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		capabilities := []string{CapabilityAsyncRequest, CapabilitySync, CapabilityRotate, CapabilityLeave}
+		if s.options.Mesh {
+			capabilities = append(capabilities, CapabilityMesh)
+		}
+		if len(s.options.DelegationPools) > 0 {
+			capabilities = append(capabilities, CapabilityPrefixDelegation)
+		}
+		if s.options.PresharedKeys {
+			capabilities = append(capabilities, CapabilityPresharedKey)
+		}
+		if s.pingURL != "" {
+			capabilities = append(capabilities, CapabilityPing)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ServerInfo{
+			ProtocolVersion: ProtocolVersion,
+			Capabilities:    capabilities,
+		})
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (s *Server) handleBinary(w http.ResponseWriter, r *http.Request) {
+	// Unknown paths, such as newer API versions, are not found
+	if r.URL.Path != "/" || !s.options.ServeBinary {
+		w.WriteHeader(404)
+		return
+	}
+	switch r.Method {
+	case "GET":
+		bin, err := os.Executable()
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		file, err := os.Open(bin)
+		if err != nil {
+			w.WriteHeader(500)
+			return
+		}
+		defer file.Close()
+		_, err = io.Copy(w, file)
+		if err != nil {
+			log.Println("WARNING: Write binary executable to response failed")
+			return
+		}
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (s *Server) handlePing(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Write([]byte("pong\n"))
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (s *Server) handleRequest(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		if s.enroller.isStopping() {
+			w.Header().Set("Retry-After", retryAfter)
+			writeError(w, 503, ErrorUnavailable, ErrShuttingDown)
+			return
+		}
+		peerConfigRequest, err := readPeerConfigRequest(w, r)
+		if err != nil {
+			writeError(w, 400, ErrorInvalidRequest, err)
+			return
+		}
+		parsedPublicKey, err := wgtypes.ParseKey(peerConfigRequest.PublicKey)
+		if err != nil {
+			writeError(w, 400, ErrorInvalidRequest, err)
+			return
+		}
+		publicKey := parsedPublicKey.String()
+		_, exists, err := configReadPeer(s.options.ConfigPath, parsedPublicKey)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+		if exists {
+			writeError(w, 409, ErrorDuplicateKey, ErrPeerExists)
+			return
+		}
+		peerEndpoint := peerConfigRequest.Endpoint
+		if len(peerEndpoint) > 0 {
+			if _, err := net.ResolveUDPAddr("udp", peerEndpoint); err != nil {
+				writeError(w, 400, ErrorInvalidRequest, err)
+				return
+			}
+		}
+		var presharedKey string
+		if s.options.PresharedKeys {
+			key, err := wgtypes.GenerateKey()
+			if err != nil {
+				log.Println(err)
+				w.WriteHeader(500)
+				return
+			}
+			presharedKey = key.String()
+		}
+
+		// Delegate routed prefixes
+		delegatedPrefixes, err := s.delegator.delegate(peerConfigRequest.DelegatePrefixLength, peerConfigRequest.AdvertisedPrefixes)
+		if errors.Is(err, ErrPrefixPoolExhausted) {
+			log.Println("WARNING: Ran out of prefixes to delegate")
+			writeError(w, 500, ErrorPoolExhausted, err)
+			return
+		}
+		if errors.Is(err, ErrPrefixOverlaps) {
+			writeError(w, 409, ErrorPrefixOverlaps, err)
+			return
+		}
+		if errors.Is(err, ErrValueParse) || errors.Is(err, ErrPrefixLength) || errors.Is(err, ErrPrefixOutsidePool) {
+			writeError(w, 400, ErrorInvalidRequest, err)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+
+		// Assign an IP address
+		ip, err := s.allocator.Allocate()
+		if errors.Is(err, ErrAddressExhausted) {
+			log.Println("WARNING: Ran out of addresses to allocate")
+			s.delegator.release(delegatedPrefixes)
+			writeError(w, 500, ErrorPoolExhausted, err)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			s.delegator.release(delegatedPrefixes)
+			w.WriteHeader(500)
+			return
+		}
+
+		req := EnrollmentRequest{
+			IP:                ip,
+			PublicKey:         publicKey,
+			PresharedKey:      presharedKey,
+			Endpoint:          peerEndpoint,
+			DelegatedPrefixes: delegatedPrefixes,
+		}
+		req.ID, err = s.enrollments.add(req)
+		if errors.Is(err, ErrPeerExists) {
+			s.release(req)
+			writeError(w, 409, ErrorDuplicateKey, err)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			s.release(req)
+			w.WriteHeader(500)
+			return
+		}
+
+		// Enqueue request into the gate without waiting for the admin. The
+		// client polls for the result
+		err = s.enroller.submit(req)
+		if err != nil {
+			s.finish(req, StatusRejected)
+			w.Header().Set("Retry-After", retryAfter)
+			writeError(w, 503, ErrorUnavailable, err)
+			return
+		}
+		if !isV1(r) {
+			s.waitRequest(w, r, req)
+			return
+		}
+
+		w.Header().Set("Location", strings.TrimSuffix(r.URL.Path, "/")+"/"+req.ID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(202)
+		json.NewEncoder(w).Encode(PeerConfigRequestStatus{
+			ID:     req.ID,
+			Status: StatusPending,
+		})
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+// waitRequest holds a legacy request until it is decided, and responds with
+// the peer config as servers did before the /v1/ API. Legacy clients cannot
+// resume waiting, so the request is cancelled if either side stops waiting
+func (s *Server) waitRequest(w http.ResponseWriter, r *http.Request, req EnrollmentRequest) {
+	done, found := s.enrollments.wait(req.ID)
+	if !found {
+		w.WriteHeader(500)
+		return
+	}
+	select {
+	case <-done:
+	case <-s.enroller.stopping:
+	case <-r.Context().Done():
+	}
+	if s.enrollments.cancel(req.ID) {
+		s.release(req)
+	}
+	// A peer that is being added is added even while shutting down
+	select {
+	case <-done:
+	case <-r.Context().Done():
+	}
+	s.enrollments.stopWaiting(req.ID)
+
+	enrollment, found := s.enrollments.get(req.ID)
+	if !found {
+		w.WriteHeader(500)
+		return
+	}
+	switch enrollment.status {
+	case StatusApproved:
+		resp, err := s.peerConfig(req.PublicKey, req.IP, req.DelegatedPrefixes)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+		resp.PresharedKey = req.PresharedKey
+		resp.Version, _ = s.versioner.current()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	case StatusRejected:
+		writeError(w, 403, ErrorRejected, nil)
+	case StatusExpired:
+		writeError(w, 408, ErrorExpired, nil)
+	default:
+		w.Header().Set("Retry-After", retryAfter)
+		writeError(w, 503, ErrorUnavailable, ErrShuttingDown)
+	}
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		id := path.Base(r.URL.Path)
+
+		// Wait a while for a pending request to be decided. The request
+		// expires if its client stops waiting and does not come back
+		done, found := s.enrollments.wait(id)
+		if !found {
+			writeError(w, 404, ErrorNotFound, nil)
+			return
+		}
+		timer := time.NewTimer(statusTimeout)
+		select {
+		case <-done:
+		case <-timer.C:
+		case <-s.enroller.stopping:
+		case <-r.Context().Done():
+		}
+		timer.Stop()
+		s.enrollments.stopWaiting(id)
+
+		enrollment, found := s.enrollments.get(id)
+		if !found {
+			writeError(w, 404, ErrorNotFound, nil)
+			return
+		}
+		// The request is gated again after a restart, unless there is no
+		// store to keep it
+		if enrollment.status == StatusPending && s.enroller.isStopping() {
+			if s.options.Store == nil && s.enrollments.cancel(id) {
+				s.release(enrollment.req)
+				enrollment.status = StatusCancelled
+			} else {
+				w.Header().Set("Retry-After", retryAfter)
+				writeError(w, 503, ErrorUnavailable, ErrShuttingDown)
+				return
+			}
+		}
+
+		status := PeerConfigRequestStatus{
+			ID:     id,
+			Status: enrollment.status,
+		}
+		if enrollment.status == StatusApproved {
+			req := enrollment.req
+			resp, err := s.peerConfig(req.PublicKey, req.IP, req.DelegatedPrefixes)
+			if err != nil {
+				log.Println(err)
+				w.WriteHeader(500)
+				return
+			}
+			resp.PresharedKey = req.PresharedKey
+			resp.Version, _ = s.versioner.current()
+			status.Config = &resp
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (s *Server) handleSync(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		peerPublicKey, ok := s.verifyRequest(w, r)
+		if !ok {
+			return
+		}
+		clientVersion, _ := strconv.ParseInt(r.URL.Query().Get("Version"), 10, 64)
+
+		// Wait for a change in configuration
+		version, changed := s.versioner.current()
+		if version == clientVersion {
+			select {
+			case <-changed:
+			case <-time.After(syncTimeout):
+			case <-s.enroller.stopping:
+				w.Header().Set("Retry-After", retryAfter)
+				writeError(w, 503, ErrorUnavailable, ErrShuttingDown)
+				return
+			case <-r.Context().Done():
+				return
+			}
+			version, _ = s.versioner.current()
+		}
+
+		// Peers removed from the config are revoked
+		peer, found, err := configReadPeer(s.options.ConfigPath, peerPublicKey)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+		if !found {
+			writeError(w, 410, ErrorRevoked, ErrPeerNotFound)
+			return
+		}
+		if version == clientVersion {
+			w.WriteHeader(304)
+			return
+		}
+
+		ip, delegatedPrefixes := splitAllowedIPs(peer.AllowedIPs, s.interfIPNet)
+		resp, err := s.peerConfig(peerPublicKey.String(), ip, delegatedPrefixes)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+		resp.PresharedKey = peerPresharedKey(peer)
+		resp.Version = version
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (s *Server) handleRotate(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		peerPublicKey, ok := s.verifyRequest(w, r)
+		if !ok {
+			return
+		}
+		rotateRequest, err := readRotateRequest(w, r)
+		if err != nil {
+			writeError(w, 400, ErrorInvalidRequest, err)
+			return
+		}
+		newPublicKey, err := wgtypes.ParseKey(rotateRequest.PublicKey)
+		if err != nil {
+			writeError(w, 400, ErrorInvalidRequest, err)
+			return
+		}
+
+		s.configLock.Lock()
+		peer, err := rotatePeer(s.device, s.options.ConfigPath, peerPublicKey, newPublicKey)
+		s.configLock.Unlock()
+		if errors.Is(err, ErrPeerNotFound) {
+			writeError(w, 410, ErrorRevoked, err)
+			return
+		}
+		if errors.Is(err, ErrPeerExists) {
+			writeError(w, 409, ErrorDuplicateKey, err)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+		s.versioner.bump()
+
+		ip, delegatedPrefixes := splitAllowedIPs(peer.AllowedIPs, s.interfIPNet)
+		resp, err := s.peerConfig(newPublicKey.String(), ip, delegatedPrefixes)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+		resp.PresharedKey = peerPresharedKey(peer)
+		resp.Version, _ = s.versioner.current()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (s *Server) handleLeave(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		peerPublicKey, ok := s.verifyRequest(w, r)
+		if !ok {
+			return
+		}
+
+		// Removing the peer from the config frees its address and
+		// delegated prefixes
+		s.configLock.Lock()
+		err := removePeer(s.device, s.options.ConfigPath, peerPublicKey)
+		s.configLock.Unlock()
+		if errors.Is(err, ErrPeerNotFound) {
+			writeError(w, 410, ErrorRevoked, err)
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+		s.versioner.bump()
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+func (s *Server) handleEndpoints(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !s.options.Mesh {
+			writeError(w, 404, ErrorNotFound, ErrMeshDisabled)
+			return
+		}
+		peerPublicKey, ok := s.verifyRequest(w, r)
+		if !ok {
+			return
+		}
+
+		// Only enrolled peers may learn endpoints of other peers
+		_, found, err := configReadPeer(s.options.ConfigPath, peerPublicKey)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+		if !found {
+			writeError(w, 403, ErrorUnauthorized, fmt.Errorf("%w: %s", ErrPeerNotFound, peerPublicKey.String()))
+			return
+		}
+
+		observed, err := readEndpoints(s.device)
+		if err != nil {
+			log.Println(err)
+			w.WriteHeader(500)
+			return
+		}
+		resp := PeerEndpointsResponse{
+			Peers: make([]PeerEndpoint, 0),
+		}
+		for publicKey, peerEndpoint := range observed {
+			if publicKey == peerPublicKey.String() {
+				continue
+			}
+			resp.Peers = append(resp.Peers, peerEndpoint)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+// writeError responds with a status and an error code, which clients map to
+// typed errors. The message describes err, if any
+func writeError(w http.ResponseWriter, status int, code string, err error) {
+	errorResponse := ErrorResponse{Error: code}
+	if err != nil {
+		errorResponse.Message = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse)
+}
+
+// maxBodySize limits request bodies of the /v1/ API and of signed requests
+const maxBodySize = 1 << 20
+
+// verifyRequest verifies a signed request, writing an error response if it
+// is not valid
+func (s *Server) verifyRequest(w http.ResponseWriter, r *http.Request) (wgtypes.Key, bool) {
+	peerPublicKey, err := VerifyRequest(w, r, s.privateKey)
+	if errors.Is(err, ErrBodyTooLarge) {
+		writeError(w, 413, ErrorInvalidRequest, err)
+		return peerPublicKey, false
+	}
+	if err != nil {
+		writeError(w, 401, ErrorUnauthorized, err)
+		return peerPublicKey, false
+	}
+	return peerPublicKey, true
+}
+
+// isV1 reports whether the request is made to the /v1/ API
+func isV1(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, "/v1/")
+}
+
+// readPeerConfigRequest decodes a JSON body for the /v1/ API, or a form for
+// the legacy path
+func readPeerConfigRequest(w http.ResponseWriter, r *http.Request) (PeerConfigRequest, error) {
+	var req PeerConfigRequest
+	if isV1(r) {
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&req)
+		return req, err
+	}
+
+	req.PublicKey = r.PostFormValue("PublicKey")
+	req.Endpoint = r.PostFormValue("Endpoint")
+	if length := r.PostFormValue("DelegatePrefixLength"); len(length) > 0 {
+		prefixLength, err := strconv.Atoi(length)
+		if err != nil {
+			return req, fmt.Errorf("%w: %v", ErrValueParse, err)
+		}
+		req.DelegatePrefixLength = prefixLength
+	}
+	req.AdvertisedPrefixes = r.PostForm["AdvertisedPrefixes"]
+	return req, nil
+}
+
+// readRotateRequest decodes a JSON body for the /v1/ API, or a form for the
+// legacy path
+func readRotateRequest(w http.ResponseWriter, r *http.Request) (RotateRequest, error) {
+	var req RotateRequest
+	if isV1(r) {
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBodySize)).Decode(&req)
+		return req, err
+	}
+	req.PublicKey = r.PostFormValue("PublicKey")
+	return req, nil
+}
+
+// tunnelPingURL returns the URL of /ping through the tunnel, if the server
+// listens on the tunnel address
+func tunnelPingURL(listen string, interfIP net.IP) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return ""
+	}
+	if host != "" {
+		listenIP := net.ParseIP(host)
+		if listenIP == nil || !(listenIP.IsUnspecified() || listenIP.Equal(interfIP)) {
+			return ""
+		}
+	}
+	return "http://" + net.JoinHostPort(interfIP.String(), port) + "/ping"
+}
@@ -0,0 +1,1115 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestEnrollerShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	enrollments, _, err := newEnrollments(FileStore{Path: filepath.Join(dir, "requests.json")}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	applying := false
+	applied := 0
+	stopped := false
+	apply := func(req EnrollmentRequest) error {
+		lock.Lock()
+		if applying {
+			t.Errorf("peers added concurrently")
+		}
+		if stopped {
+			t.Errorf("peer %v added after shutdown", req.PublicKey)
+		}
+		applying = true
+		lock.Unlock()
+
+		time.Sleep(time.Millisecond)
+
+		lock.Lock()
+		applying = false
+		applied++
+		lock.Unlock()
+		return nil
+	}
+	finish := func(req EnrollmentRequest, status string) {
+		enrollments.finish(req.ID, status)
+	}
+	enroller := newEnroller(AllowAll, enrollments, apply, finish)
+	enroller.start()
+
+	// Submit requests concurrently while shutting down
+	var wg sync.WaitGroup
+	ids := make(chan string, 100)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := EnrollmentRequest{PublicKey: fmt.Sprintf("peer%d", i), IP: net.IPv4(10, 0, 0, byte(i+2))}
+			id, err := enrollments.add(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req.ID = id
+			err = enroller.submit(req)
+			if errors.Is(err, ErrShuttingDown) {
+				finish(req, StatusRejected)
+			} else if err != nil {
+				t.Error(err)
+			}
+			ids <- id
+		}(i)
+		if i == 50 {
+			enroller.stop()
+		}
+	}
+	wg.Wait()
+	close(ids)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err = enroller.wait(ctx)
+	if err != nil {
+		t.Fatalf("wait failed: %v", err)
+	}
+	lock.Lock()
+	stopped = true
+	lock.Unlock()
+
+	// Every request is either added, or rejected or left pending without being
+	// added
+	approved := 0
+	for id := range ids {
+		enrollment, found := enrollments.get(id)
+		if !found {
+			t.Fatalf("request %v not found", id)
+		}
+		switch enrollment.status {
+		case StatusApproved:
+			approved++
+		case StatusPending, StatusRejected:
+		default:
+			t.Errorf("request %v has status %v", id, enrollment.status)
+		}
+	}
+	if approved != applied {
+		t.Errorf("%v requests approved, but %v peers added", approved, applied)
+	}
+
+	err = enroller.submit(EnrollmentRequest{})
+	if !errors.Is(err, ErrShuttingDown) {
+		t.Errorf("got error %v, want %v", err, ErrShuttingDown)
+	}
+}
+
+func TestServerEndToEnd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(timeout time.Duration) {
+		syncTimeout = timeout
+	}(syncTimeout)
+	syncTimeout = time.Second
+
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "wgn0.conf")
+	err = ioutil.WriteFile(configPath, []byte("[Interface]\nPrivateKey = "+serverKey.String()+"\nListenPort = 51820\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []wgtypes.Key
+	for i := 0; i < 4; i++ {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	rejected := keys[2].PublicKey().String()
+
+	device := NewMemoryDevice("wgn0", net.IPNet{IP: net.IPv4(10, 90, 0, 1), Mask: net.CIDRMask(24, 32)})
+	var gated []string
+	var gateLock sync.Mutex
+	server, err := NewServer(ServerOptions{
+		InterfaceName: "wgn0",
+		ConfigPath:    configPath,
+		Endpoint:      "192.0.2.1:51820",
+		Mesh:          true,
+		Gate: GateFunc(func(req EnrollmentRequest) (bool, error) {
+			gateLock.Lock()
+			gated = append(gated, req.PublicKey)
+			gateLock.Unlock()
+			return req.PublicKey != rejected, nil
+		}),
+		Store:  FileStore{Path: filepath.Join(dir, "requests.json")},
+		Device: device,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	defer server.Shutdown(context.Background())
+
+	client, err := NewClient(ts.URL, ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Addresses are allocated in order
+	var responses []PeerConfigResponse
+	for i, key := range keys[:2] {
+		resp, err := client.Request(ctx, PeerConfigRequest{PublicKey: key.PublicKey().String()})
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		want := fmt.Sprintf("10.90.0.%d/24", i+2)
+		if len(resp.InterfaceIPs) != 1 || resp.InterfaceIPs[0] != want {
+			t.Errorf("got interface IPs %v, want %v", resp.InterfaceIPs, want)
+		}
+		if resp.PublicKey != serverKey.PublicKey().String() {
+			t.Errorf("got server public key %v, want %v", resp.PublicKey, serverKey.PublicKey())
+		}
+		if resp.Endpoint != "192.0.2.1:51820" {
+			t.Errorf("got endpoint %v, want 192.0.2.1:51820", resp.Endpoint)
+		}
+		responses = append(responses, resp)
+	}
+	if len(responses[1].Peers) != 1 || responses[1].Peers[0].PublicKey != keys[0].PublicKey().String() {
+		t.Errorf("got mesh peers %v, want %v", responses[1].Peers, keys[0].PublicKey())
+	}
+
+	// The gate decides, and rejected peers are not added
+	_, err = client.Request(ctx, PeerConfigRequest{PublicKey: rejected})
+	if !errors.Is(err, ErrRejected) {
+		t.Errorf("got error %v, want %v", err, ErrRejected)
+	}
+	gateLock.Lock()
+	if len(gated) != 3 {
+		t.Errorf("gate called for %v, want 3 requests", gated)
+	}
+	gateLock.Unlock()
+
+	// Duplicate keys are refused
+	_, err = client.Request(ctx, PeerConfigRequest{PublicKey: keys[0].PublicKey().String()})
+	if !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("got error %v, want %v", err, ErrDuplicateKey)
+	}
+
+	// Approved peers are written to the config file and added to the device
+	config, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, key := range keys[:2] {
+		if !strings.Contains(string(config), key.PublicKey().String()) {
+			t.Errorf("config missing peer %v:\n%s", i, config)
+		}
+	}
+	if strings.Contains(string(config), rejected) {
+		t.Errorf("config contains rejected peer:\n%s", config)
+	}
+	wgDevice, err := device.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowedIPs := make(map[string]string)
+	for _, peer := range wgDevice.Peers {
+		for _, allowedIP := range peer.AllowedIPs {
+			allowedIPs[peer.PublicKey.String()] = allowedIP.String()
+		}
+	}
+	if len(allowedIPs) != 2 || allowedIPs[keys[0].PublicKey().String()] != "10.90.0.2/32" || allowedIPs[keys[1].PublicKey().String()] != "10.90.0.3/32" {
+		t.Errorf("got device peers %v", allowedIPs)
+	}
+
+	// The client writes its configuration from the response
+	clientPath := filepath.Join(dir, "wgn1")
+	backend, err := NewBackend("networkd", BackendOptions{
+		InterfaceName: "wgn1",
+		ConfigPath:    clientPath,
+		VerifyTimeout: -1,
+		Runner:        &fakeRunner{},
+		Device:        &fakeDevice{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = backend.Write(InterfaceAndPeerConfig{
+		PeerConfigResponse: responses[0],
+		PrivateKey:         keys[0].String(),
+		InterfaceName:      "wgn1",
+	})
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	network, err := ioutil.ReadFile(clientPath + ".network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(network), "Address = 10.90.0.2/24") {
+		t.Errorf("network missing address:\n%s", network)
+	}
+	netdev, err := ioutil.ReadFile(clientPath + ".netdev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(netdev), "PublicKey = "+serverKey.PublicKey().String()) {
+		t.Errorf("netdev missing server peer:\n%s", netdev)
+	}
+
+	// Peers observed by the device are returned as endpoints
+	endpoint := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 2), Port: 51820}
+	err = device.SetEndpoint(keys[1].PublicKey(), endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoints, err := client.Endpoints(ctx, keys[0], serverKey.PublicKey())
+	if err != nil {
+		t.Fatalf("endpoints failed: %v", err)
+	}
+	if len(endpoints) != 1 || endpoints[0].Endpoint != endpoint.String() {
+		t.Errorf("got endpoints %v, want %v", endpoints, endpoint)
+	}
+	unenrolledKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Endpoints(ctx, unenrolledKey, serverKey.PublicKey())
+	if !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("got error %v, want %v", err, ErrUnauthorized)
+	}
+
+	// The agent receives the current configuration, then long polls with its
+	// version until the timeout
+	synced, changed, err := client.Sync(ctx, keys[0], serverKey.PublicKey(), 0)
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if !changed {
+		t.Fatalf("sync unchanged, want the current configuration")
+	}
+	start := time.Now()
+	_, changed, err = client.Sync(ctx, keys[0], serverKey.PublicKey(), synced.Version)
+	if err != nil {
+		t.Fatalf("sync failed: %v", err)
+	}
+	if changed {
+		t.Errorf("sync changed without a change in configuration")
+	}
+	if elapsed := time.Since(start); elapsed < syncTimeout {
+		t.Errorf("sync returned after %v, before the timeout", elapsed)
+	}
+
+	// The agent applies the configuration to its interface
+	clientDevice := NewMemoryDevice("wgn1")
+	apply := func(resp PeerConfigResponse) {
+		t.Helper()
+		wgConfig, err := InterfaceAndPeerConfig{
+			PeerConfigResponse: resp,
+			PrivateKey:         keys[0].String(),
+			InterfaceName:      "wgn1",
+		}.DeviceConfig()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = clientDevice.Configure(wgConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	apply(synced)
+
+	// A new peer wakes the long poll before the timeout
+	type syncResult struct {
+		resp    PeerConfigResponse
+		changed bool
+		err     error
+	}
+	polled := make(chan syncResult, 1)
+	start = time.Now()
+	go func() {
+		resp, changed, err := client.Sync(ctx, keys[0], serverKey.PublicKey(), synced.Version)
+		polled <- syncResult{resp, changed, err}
+	}()
+	_, err = client.Request(ctx, PeerConfigRequest{PublicKey: keys[3].PublicKey().String()})
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	result := <-polled
+	if result.err != nil {
+		t.Fatalf("sync failed: %v", result.err)
+	}
+	if !result.changed || result.resp.Version == synced.Version {
+		t.Fatalf("sync unchanged after a new peer")
+	}
+	if elapsed := time.Since(start); elapsed >= syncTimeout {
+		t.Errorf("sync returned after %v, not woken by the change", elapsed)
+	}
+
+	// The agent replaces the peers of its interface with the new peer set
+	apply(result.resp)
+	clientWgDevice, err := clientDevice.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientPeers := make(map[wgtypes.Key]bool)
+	for _, peer := range clientWgDevice.Peers {
+		clientPeers[peer.PublicKey] = true
+	}
+	if len(clientPeers) != 3 || !clientPeers[serverKey.PublicKey()] || !clientPeers[keys[1].PublicKey()] || !clientPeers[keys[3].PublicKey()] {
+		t.Errorf("got client peers %v, want server, peer 1 and peer 3", clientWgDevice.Peers)
+	}
+
+	// Leaving removes the peer from the config file and the device
+	err = client.Leave(ctx, keys[0], serverKey.PublicKey())
+	if err != nil {
+		t.Fatalf("leave failed: %v", err)
+	}
+	config, err = ioutil.ReadFile(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(config), keys[0].PublicKey().String()) {
+		t.Errorf("config contains removed peer:\n%s", config)
+	}
+	wgDevice, err = device.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, peer := range wgDevice.Peers {
+		if peer.PublicKey == keys[0].PublicKey() {
+			t.Errorf("device contains removed peer")
+		}
+	}
+	if len(wgDevice.Peers) != 2 {
+		t.Errorf("got device peers %v, want 2 peers", wgDevice.Peers)
+	}
+}
+
+func TestServerRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "wgn0.conf")
+	err = ioutil.WriteFile(configPath, []byte("[Interface]\nPrivateKey = "+serverKey.String()+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []wgtypes.Key
+	for i := 0; i < 3; i++ {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	oldKey, newKey, otherKey := keys[0], keys[1], keys[2]
+
+	device := NewMemoryDevice("wgn0", net.IPNet{IP: net.IPv4(10, 90, 0, 1), Mask: net.CIDRMask(24, 32)})
+	server, err := NewServer(ServerOptions{
+		InterfaceName: "wgn0",
+		ConfigPath:    configPath,
+		Device:        device,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	defer server.Shutdown(context.Background())
+
+	client, err := NewClient(ts.URL, ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, key := range []wgtypes.Key{oldKey, otherKey} {
+		_, err = client.Request(ctx, PeerConfigRequest{PublicKey: key.PublicKey().String()})
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+	}
+
+	// Rotating keeps the address of the peer
+	resp, err := client.Rotate(ctx, oldKey, serverKey.PublicKey(), newKey.PublicKey())
+	if err != nil {
+		t.Fatalf("rotate failed: %v", err)
+	}
+	if len(resp.InterfaceIPs) != 1 || resp.InterfaceIPs[0] != "10.90.0.2/24" {
+		t.Errorf("got interface IPs %v, want 10.90.0.2/24", resp.InterfaceIPs)
+	}
+
+	// The old key is replaced by the new key on the device
+	wgDevice, err := device.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowedIPs := make(map[wgtypes.Key][]string)
+	for _, peer := range wgDevice.Peers {
+		for _, allowedIP := range peer.AllowedIPs {
+			allowedIPs[peer.PublicKey] = append(allowedIPs[peer.PublicKey], allowedIP.String())
+		}
+	}
+	if _, found := allowedIPs[oldKey.PublicKey()]; found {
+		t.Errorf("device contains the old key")
+	}
+	if got := allowedIPs[newKey.PublicKey()]; len(got) != 1 || got[0] != "10.90.0.2/32" {
+		t.Errorf("got allowed IPs %v for the new key, want 10.90.0.2/32", got)
+	}
+	if len(allowedIPs) != 2 {
+		t.Errorf("got device peers %v, want 2 peers", allowedIPs)
+	}
+
+	// and in the config file
+	_, found, err := configReadPeer(configPath, oldKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Errorf("config contains the old key")
+	}
+	peer, found, err := configReadPeer(configPath, newKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatalf("config missing the new key")
+	}
+	if len(peer.AllowedIPs) != 1 || peer.AllowedIPs[0].String() != "10.90.0.2/32" {
+		t.Errorf("got allowed IPs %v for the new key, want 10.90.0.2/32", peer.AllowedIPs)
+	}
+	_, found, err = configReadPeer(configPath, otherKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Errorf("config missing the other peer")
+	}
+
+	// The old key is revoked, and rotating to an existing key is refused
+	_, err = client.Rotate(ctx, oldKey, serverKey.PublicKey(), oldKey.PublicKey())
+	if !errors.Is(err, ErrRevoked) {
+		t.Errorf("got error %v, want %v", err, ErrRevoked)
+	}
+	_, err = client.Rotate(ctx, newKey, serverKey.PublicKey(), otherKey.PublicKey())
+	if !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("got error %v, want %v", err, ErrDuplicateKey)
+	}
+}
+
+// failingDevice fails to add the peer with the given key
+type failingDevice struct {
+	*MemoryDevice
+	publicKey wgtypes.Key
+}
+
+func (d failingDevice) AddPeer(peer wgtypes.PeerConfig) error {
+	if peer.PublicKey == d.publicKey {
+		return errors.New("injected failure")
+	}
+	return d.MemoryDevice.AddPeer(peer)
+}
+
+func TestRotatePeerRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "wgn0.conf")
+	err = ioutil.WriteFile(configPath, []byte("[Interface]\nPrivateKey = "+serverKey.String()+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.IPv4(10, 90, 0, 2)
+	err = configAddPeer(configPath, EnrollmentRequest{PublicKey: oldKey.PublicKey().String(), IP: ip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := NewMemoryDevice("wgn0", net.IPNet{IP: net.IPv4(10, 90, 0, 1), Mask: net.CIDRMask(24, 32)})
+	err = memory.AddPeer(wgtypes.PeerConfig{
+		PublicKey:  oldKey.PublicKey(),
+		AllowedIPs: []net.IPNet{ipToIPNetWithHostMask(ip)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Adding the rotated peer fails, so the original peer is restored
+	device := failingDevice{memory, newKey.PublicKey()}
+	_, err = rotatePeer(device, configPath, oldKey.PublicKey(), newKey.PublicKey())
+	if err == nil {
+		t.Fatalf("rotate succeeded, want an error")
+	}
+
+	wgDevice, err := memory.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wgDevice.Peers) != 1 || wgDevice.Peers[0].PublicKey != oldKey.PublicKey() {
+		t.Errorf("got device peers %v, want only the old key", wgDevice.Peers)
+	} else if allowedIPs := wgDevice.Peers[0].AllowedIPs; len(allowedIPs) != 1 || allowedIPs[0].String() != "10.90.0.2/32" {
+		t.Errorf("got allowed IPs %v for the old key, want 10.90.0.2/32", allowedIPs)
+	}
+	_, found, err := configReadPeer(configPath, oldKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Errorf("config missing the old key")
+	}
+	_, found, err = configReadPeer(configPath, newKey.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Errorf("config contains the new key")
+	}
+}
+
+func TestInitServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "wgntest0.conf")
+	networkdPath := filepath.Join(dir, "wgntest0")
+
+	runner := &fakeRunner{}
+	device := &fakeDevice{}
+	options := ServerInitOptions{
+		InterfaceName: "wgntest0",
+		ConfigPath:    configPath,
+		Address:       net.IPNet{IP: net.IPv4(10, 90, 0, 1), Mask: net.CIDRMask(24, 32)},
+		ListenPort:    51820,
+		NetworkdPath:  networkdPath,
+		VerifyTimeout: -1,
+		Runner:        runner,
+		Device:        device,
+	}
+	privateKey, err := InitServer(options)
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+
+	// The server reads its key from the configuration file
+	serverPrivateKey, err := configReadInterfacePrivateKey(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serverPrivateKey != privateKey {
+		t.Errorf("config has private key %v, want %v", serverPrivateKey, privateKey)
+	}
+	info, err := os.Stat(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("config has mode %v", info.Mode().Perm())
+	}
+	want := []string{
+		"ip link add wgntest0 type wireguard",
+		"ip address add 10.90.0.1/24 dev wgntest0",
+		"ip link set wgntest0 up",
+	}
+	if strings.Join(runner.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ran %v, want %v", runner.commands, want)
+	}
+	if len(device.configs) != 1 || *device.configs[0].PrivateKey != privateKey || *device.configs[0].ListenPort != 51820 {
+		t.Errorf("got device configs %v", device.configs)
+	}
+
+	// Existing configuration is not overwritten
+	_, err = InitServer(options)
+	if !errors.Is(err, os.ErrExist) {
+		t.Errorf("got error %v, want %v", err, os.ErrExist)
+	}
+
+	// networkd creates the interface from units
+	os.Remove(configPath)
+	runner.commands = nil
+	options.Networkd = true
+	_, err = InitServer(options)
+	if err != nil {
+		t.Fatalf("init failed: %v", err)
+	}
+	if want := []string{"systemctl restart systemd-networkd"}; strings.Join(runner.commands, "\n") != strings.Join(want, "\n") {
+		t.Errorf("ran %v, want %v", runner.commands, want)
+	}
+	netdev, err := ioutil.ReadFile(networkdPath + ".netdev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(netdev), "PrivateKeyFile = "+networkdPath+".key") || !strings.Contains(string(netdev), "ListenPort = 51820") {
+		t.Errorf("netdev not valid:\n%s", netdev)
+	}
+	network, err := ioutil.ReadFile(networkdPath + ".network")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(network), "Address = 10.90.0.1/24") {
+		t.Errorf("network missing address:\n%s", network)
+	}
+}
+
+func TestServerReconcile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var keys []wgtypes.Key
+	for i := 0; i < 3; i++ {
+		key, err := wgtypes.GeneratePrivateKey()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	serverKey, added, removed := keys[0], keys[1].PublicKey(), keys[2].PublicKey()
+	configPath := filepath.Join(dir, "wgn0.conf")
+	err = ioutil.WriteFile(configPath, []byte("[Interface]\nPrivateKey = "+serverKey.String()+"\nListenPort = 51820\n\n[Peer]\nPublicKey = "+removed.String()+"\nAllowedIPs = 10.90.0.2/32\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := NewMemoryDevice("wgn0", net.IPNet{IP: net.IPv4(10, 90, 0, 1), Mask: net.CIDRMask(24, 32)})
+
+	newServer := func(reconcile string) *Server {
+		server, err := NewServer(ServerOptions{
+			InterfaceName: "wgn0",
+			ConfigPath:    configPath,
+			ApplyOnStart:  true,
+			Reconcile:     reconcile,
+			Device:        device,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return server
+	}
+	drifted := func() drift {
+		wgConfig, err := configRead(configPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wgDevice, err := device.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return diffDevice(wgConfig, wgDevice)
+	}
+	liveAllowedIPs := []net.IPNet{{IP: net.IPv4(10, 90, 0, 5), Mask: net.CIDRMask(32, 32)}}
+
+	// The config is applied on start
+	server := newServer(ReconcileDevice)
+	if d := drifted(); !d.empty() {
+		t.Errorf("got drift %+v after applying on start", d)
+	}
+
+	// The interface is converged to the config
+	device.RemovePeer(removed)
+	device.AddPeer(wgtypes.PeerConfig{PublicKey: added, AllowedIPs: liveAllowedIPs})
+	if d := drifted(); len(d.missing) != 1 || len(d.unknown) != 1 {
+		t.Errorf("got drift %+v, want one missing and one unknown peer", d)
+	}
+	err = server.Reconcile()
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if d := drifted(); !d.empty() {
+		t.Errorf("got drift %+v after converging the interface", d)
+	}
+	server.Shutdown(context.Background())
+
+	// The config is converged to the interface
+	server = newServer(ReconcileConfig)
+	defer server.Shutdown(context.Background())
+	device.RemovePeer(removed)
+	device.AddPeer(wgtypes.PeerConfig{PublicKey: added, AllowedIPs: liveAllowedIPs})
+	err = server.Reconcile()
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if d := drifted(); len(d.missing) != 1 || len(d.unknown) != 0 || len(d.changed) != 0 {
+		t.Errorf("got drift %+v after adopting the interface, want only the missing peer", d)
+	}
+	peer, found, err := configReadPeer(configPath, added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found || !sameIPNets(peer.AllowedIPs, liveAllowedIPs) {
+		t.Errorf("got peer %v in config, want allowed IPs %v", peer, liveAllowedIPs)
+	}
+	_, found, err = configReadPeer(configPath, removed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Errorf("peer %v missing on the interface was removed from the config", removed)
+	}
+
+	// A missing peer alone leaves the config, and its version, unchanged
+	version, _ := server.versioner.current()
+	err = server.Reconcile()
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if got, _ := server.versioner.current(); got != version {
+		t.Errorf("got version %v after reconciling a missing peer, want %v", got, version)
+	}
+
+	// Changed allowed IPs are adopted
+	changedAllowedIPs := append(liveAllowedIPs, net.IPNet{IP: net.IPv4(10, 100, 0, 0), Mask: net.CIDRMask(24, 32)})
+	device.AddPeer(wgtypes.PeerConfig{PublicKey: added, AllowedIPs: changedAllowedIPs})
+	err = server.Reconcile()
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	peer, _, err = configReadPeer(configPath, added)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sameIPNets(peer.AllowedIPs, changedAllowedIPs) {
+		t.Errorf("got allowed IPs %v in config, want %v", peer.AllowedIPs, changedAllowedIPs)
+	}
+}
+
+func TestServerShutdownCancels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "wgn0.conf")
+	err = ioutil.WriteFile(configPath, []byte("[Interface]\nPrivateKey = "+serverKey.String()+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The gate never decides, and there is no store to keep the request
+	gated := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	server, err := NewServer(ServerOptions{
+		InterfaceName: "wgn0",
+		ConfigPath:    configPath,
+		Gate: GateFunc(func(req EnrollmentRequest) (bool, error) {
+			close(gated)
+			<-release
+			return false, nil
+		}),
+		Device: NewMemoryDevice("wgn0", net.IPNet{IP: net.IPv4(10, 90, 0, 1), Mask: net.CIDRMask(24, 32)}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	client, err := NewClient(ts.URL, ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := client.Submit(ctx, PeerConfigRequest{PublicKey: key.PublicKey().String()})
+	if err != nil {
+		t.Fatalf("submit failed: %v", err)
+	}
+	<-gated
+	err = server.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	_, err = client.Wait(ctx, id)
+	if !errors.Is(err, ErrCancelled) {
+		t.Errorf("got error %v, want %v", err, ErrCancelled)
+	}
+}
+
+func TestServerLegacyRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "wgn0.conf")
+	err = ioutil.WriteFile(configPath, []byte("[Interface]\nPrivateKey = "+serverKey.String()+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := key.PublicKey().String()
+
+	server, err := NewServer(ServerOptions{
+		InterfaceName: "wgn0",
+		ConfigPath:    configPath,
+		Gate: GateFunc(func(req EnrollmentRequest) (bool, error) {
+			return req.PublicKey != rejected, nil
+		}),
+		Device: NewMemoryDevice("wgn0", net.IPNet{IP: net.IPv4(10, 90, 0, 1), Mask: net.CIDRMask(24, 32)}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	defer server.Shutdown(context.Background())
+
+	// Clients from before the /v1/ API receive the peer config in the response
+	key, err = wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.PostForm(ts.URL+"/request", url.Values{"PublicKey": {key.PublicKey().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %v, want %v", resp.StatusCode, http.StatusOK)
+	}
+	var peerConfigResponse PeerConfigResponse
+	err = json.NewDecoder(resp.Body).Decode(&peerConfigResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peerConfigResponse.InterfaceIPs) != 1 || peerConfigResponse.InterfaceIPs[0] != "10.90.0.2/24" {
+		t.Errorf("got interface IPs %v, want 10.90.0.2/24", peerConfigResponse.InterfaceIPs)
+	}
+
+	resp, err = http.PostForm(ts.URL+"/request", url.Values{"PublicKey": {rejected}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %v for rejected request, want %v", resp.StatusCode, http.StatusForbidden)
+	}
+}
+
+func TestServerLegacyRequestDisconnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wgn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "wgn0.conf")
+	err = ioutil.WriteFile(configPath, []byte("[Interface]\nPrivateKey = "+serverKey.String()+"\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := FileStore{Path: filepath.Join(dir, "requests.json")}
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The gate holds the request until the client disconnects
+	gated := make(chan struct{})
+	release := make(chan struct{})
+	server, err := NewServer(ServerOptions{
+		InterfaceName: "wgn0",
+		ConfigPath:    configPath,
+		Gate: GateFunc(func(req EnrollmentRequest) (bool, error) {
+			close(gated)
+			<-release
+			return true, nil
+		}),
+		Store:  store,
+		Device: NewMemoryDevice("wgn0", net.IPNet{IP: net.IPv4(10, 90, 0, 1), Mask: net.CIDRMask(24, 32)}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequest("POST", ts.URL+"/request", strings.NewReader(url.Values{"PublicKey": {key.PublicKey().String()}}.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	go func() {
+		<-gated
+		cancel()
+	}()
+	_, err = http.DefaultClient.Do(req.WithContext(ctx))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+
+	// The cancellation is saved to the store
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		records, err := store.Load()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(records) == 1 && records[0].Status == StatusCancelled {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got records %v, want the request cancelled", records)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	err = server.Shutdown(context.Background())
+	if err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	ts.Close()
+
+	// After a restart, the cancelled request is not gated again
+	var gatedKeys []string
+	var gateLock sync.Mutex
+	server, err = NewServer(ServerOptions{
+		InterfaceName: "wgn0",
+		ConfigPath:    configPath,
+		Gate: GateFunc(func(req EnrollmentRequest) (bool, error) {
+			gateLock.Lock()
+			gatedKeys = append(gatedKeys, req.PublicKey)
+			gateLock.Unlock()
+			return true, nil
+		}),
+		Store:  store,
+		Device: NewMemoryDevice("wgn0", net.IPNet{IP: net.IPv4(10, 90, 0, 1), Mask: net.CIDRMask(24, 32)}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts = httptest.NewServer(server)
+	defer ts.Close()
+	defer server.Shutdown(context.Background())
+	client, err := NewClient(ts.URL, ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Requests are gated in order, so the new request is gated after any
+	// request restored from the store
+	waitCtx, waitCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer waitCancel()
+	_, err = client.Request(waitCtx, PeerConfigRequest{PublicKey: otherKey.PublicKey().String()})
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	gateLock.Lock()
+	defer gateLock.Unlock()
+	if len(gatedKeys) != 1 || gatedKeys[0] != otherKey.PublicKey().String() {
+		t.Errorf("gated %v, want only the new request", gatedKeys)
+	}
+}
+
+func TestEnrollerOrder(t *testing.T) {
+	enrollments, _, err := newEnrollments(nil, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gated := make(chan string, 100)
+	gate := GateFunc(func(req EnrollmentRequest) (bool, error) {
+		gated <- req.PublicKey
+		return false, nil
+	})
+	finish := func(req EnrollmentRequest, status string) {
+		enrollments.finish(req.ID, status)
+	}
+	enroller := newEnroller(gate, enrollments, func(EnrollmentRequest) error { return nil }, finish)
+	enroller.start()
+	defer enroller.stop()
+
+	for i := 0; i < 100; i++ {
+		req := EnrollmentRequest{PublicKey: fmt.Sprintf("peer%d", i), IP: net.IPv4(10, 0, 0, byte(i+2))}
+		req.ID, err = enrollments.add(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = enroller.submit(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100; i++ {
+		if publicKey, want := <-gated, fmt.Sprintf("peer%d", i); publicKey != want {
+			t.Fatalf("gated %v, want %v", publicKey, want)
+		}
+	}
+}
@@ -0,0 +1,552 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+	"gopkg.in/ini.v1"
+)
+
+func configAddPeer(config string, req EnrollmentRequest) error {
+	// For every request, open the config file again and rewrite it. Acceptable
+	// because this happens infrequently
+
+	// Preferably in the future, treat the configuration as a database
+
+	// For now, append to the config file
+	cfg := ini.Empty()
+	sec, _ := cfg.NewSection("Peer")
+	publicKey := sec.Key("PublicKey")
+	// TODO: Validation is needed
+	publicKey.SetValue(req.PublicKey)
+	allowedIPs := sec.Key("AllowedIPs")
+	allowedHost := ipToIPNetWithHostMask(req.IP)
+	allowedIPsValue := []string{(&allowedHost).String()}
+	for _, prefix := range req.DelegatedPrefixes {
+		allowedIPsValue = append(allowedIPsValue, prefix.String())
+	}
+	allowedIPs.SetValue(strings.Join(allowedIPsValue, ", "))
+	if len(req.Endpoint) > 0 {
+		endpoint := sec.Key("Endpoint")
+		endpoint.SetValue(req.Endpoint)
+	}
+	if len(req.PresharedKey) > 0 {
+		presharedKey := sec.Key("PresharedKey")
+		presharedKey.SetValue(req.PresharedKey)
+	}
+
+	return configAppend(config, cfg)
+}
+
+// configAppendPeer appends a peer read from the interface to the config
+func configAppendPeer(config string, peer wgtypes.Peer) error {
+	cfg := ini.Empty()
+	sec, _ := cfg.NewSection("Peer")
+	sec.Key("PublicKey").SetValue(peer.PublicKey.String())
+	sec.Key("AllowedIPs").SetValue(formatAllowedIPs(peer.AllowedIPs))
+	if peer.PresharedKey != (wgtypes.Key{}) {
+		sec.Key("PresharedKey").SetValue(peer.PresharedKey.String())
+	}
+	if peer.PersistentKeepaliveInterval > 0 {
+		sec.Key("PersistentKeepalive").SetValue(formatPersistentKeepalive(peer.PersistentKeepaliveInterval))
+	}
+	return configAppend(config, cfg)
+}
+
+// configAppend appends sections to the config. The config is replaced at
+// once, so that concurrent reads never see a partly written section
+func configAppend(config string, cfg *ini.File) error {
+	b, err := ioutil.ReadFile(config)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("opening %s failed: %w", config, err)
+	}
+	// The config contains the private key of the server and preshared keys
+	perm := os.FileMode(0600)
+	if info, err := os.Stat(config); err == nil {
+		perm = info.Mode().Perm()
+	}
+
+	buf := bytes.NewBuffer(b)
+	_, err = cfg.WriteTo(buf)
+	if err != nil {
+		return fmt.Errorf("writing to %s failed: %w", config, err)
+	}
+	return configReplace(config, buf.Bytes(), perm)
+}
+
+// configReplace writes the config to a temporary file and renames it over the
+// config
+func configReplace(config string, content []byte, perm os.FileMode) error {
+	tmp := config + ".tmp"
+	err := ioutil.WriteFile(tmp, content, perm)
+	if err != nil {
+		return fmt.Errorf("writing %s failed: %w", tmp, err)
+	}
+	err = os.Rename(tmp, config)
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing %s failed: %w", config, err)
+	}
+	return nil
+}
+
+func configReadAllowedIPs(config string) ([]net.IPNet, error) {
+	f, err := os.Open(config)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s failed: %w", config, err)
+	}
+	defer f.Close()
+
+	device, _, err := ReadConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("read allowed IPs failed: %w", err)
+	}
+
+	var allowedIPs []net.IPNet
+	for _, peer := range device.Peers {
+		allowedIPs = append(allowedIPs, peer.AllowedIPs...)
+	}
+	return allowedIPs, nil
+}
+
+// meshPeers lists every peer in the config other than the given peer. An
+// endpoint reported by the peer is preferred over the endpoint observed on the
+// interface
+func meshPeers(device Device, config string, exclude string) ([]PeerConfig, error) {
+	f, err := os.Open(config)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s failed: %w", config, err)
+	}
+	defer f.Close()
+
+	wgConfig, _, err := ReadConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("read mesh peers failed: %w", err)
+	}
+
+	observed, err := readEndpoints(device)
+	if err != nil {
+		log.Printf("WARNING: Unable to read observed endpoints: %v\n", err)
+	}
+
+	peers := make([]PeerConfig, 0)
+	for _, peer := range wgConfig.Peers {
+		publicKey := peer.PublicKey.String()
+		if publicKey == exclude {
+			continue
+		}
+
+		endpoint := observed[publicKey].Endpoint
+		if peer.Endpoint != nil {
+			endpoint = peer.Endpoint.String()
+		}
+		allowedIPs := make([]string, len(peer.AllowedIPs))
+		for i, allowedIP := range peer.AllowedIPs {
+			allowedIPs[i] = allowedIP.String()
+		}
+
+		peers = append(peers, PeerConfig{
+			PublicKey:           publicKey,
+			Endpoint:            endpoint,
+			AllowedIPs:          allowedIPs,
+			PersistentKeepalive: 25,
+		})
+	}
+	return peers, nil
+}
+
+func configReadPeer(config string, publicKey wgtypes.Key) (wgtypes.PeerConfig, bool, error) {
+	f, err := os.Open(config)
+	if err != nil {
+		return wgtypes.PeerConfig{}, false, fmt.Errorf("opening %s failed: %w", config, err)
+	}
+	defer f.Close()
+
+	device, _, err := ReadConfig(f)
+	if err != nil {
+		return wgtypes.PeerConfig{}, false, fmt.Errorf("read peer failed: %w", err)
+	}
+
+	for _, peer := range device.Peers {
+		if peer.PublicKey == publicKey {
+			return peer, true, nil
+		}
+	}
+	return wgtypes.PeerConfig{}, false, nil
+}
+
+// peerPresharedKey returns the preshared key of a peer read from the config,
+// or an empty string if it has none
+func peerPresharedKey(peer wgtypes.PeerConfig) string {
+	if peer.PresharedKey == nil || *peer.PresharedKey == (wgtypes.Key{}) {
+		return ""
+	}
+	return peer.PresharedKey.String()
+}
+
+// configEditPeer rewrites the [Peer] section with the public key, keeping the
+// rest of the config as it is. The edit function receives the lines of the
+// section and returns their replacement
+func configEditPeer(config string, publicKey wgtypes.Key, edit func(lines []string) []string) error {
+	b, err := ioutil.ReadFile(config)
+	if err != nil {
+		return fmt.Errorf("opening %s failed: %w", config, err)
+	}
+	info, err := os.Stat(config)
+	if err != nil {
+		return fmt.Errorf("opening %s failed: %w", config, err)
+	}
+
+	var out, section []string
+	found := false
+	flush := func() {
+		if configIsPeerSection(section, publicKey) {
+			section = edit(section)
+			found = true
+		}
+		out = append(out, section...)
+		section = nil
+	}
+	for _, line := range strings.SplitAfter(string(b), "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "[") {
+			flush()
+		}
+		section = append(section, line)
+	}
+	flush()
+	if !found {
+		return fmt.Errorf("%w: %s", ErrPeerNotFound, publicKey.String())
+	}
+
+	// Replace the config at once, so that a failure does not lose peers
+	return configReplace(config, []byte(strings.Join(out, "")), info.Mode().Perm())
+}
+
+func configIsPeerSection(lines []string, publicKey wgtypes.Key) bool {
+	if len(lines) == 0 || !strings.EqualFold(strings.TrimSpace(lines[0]), "[Peer]") {
+		return false
+	}
+	for _, line := range lines[1:] {
+		key, value := configSplitLine(line)
+		if strings.EqualFold(key, "PublicKey") {
+			sectionPublicKey, err := wgtypes.ParseKey(value)
+			return err == nil && sectionPublicKey == publicKey
+		}
+	}
+	return false
+}
+
+// configSplitLine returns the key and value of a config line
+func configSplitLine(line string) (string, string) {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		return "", ""
+	}
+	return strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+}
+
+// rotatePeer replaces the public key of a peer in the config and on the
+// interface, returning the peer
+func rotatePeer(device Device, config string, publicKey wgtypes.Key, newPublicKey wgtypes.Key) (wgtypes.PeerConfig, error) {
+	peer, found, err := configReadPeer(config, publicKey)
+	if err != nil {
+		return peer, err
+	}
+	if !found {
+		return peer, fmt.Errorf("%w: %s", ErrPeerNotFound, publicKey.String())
+	}
+	_, exists, err := configReadPeer(config, newPublicKey)
+	if err != nil {
+		return peer, err
+	}
+	if exists {
+		return peer, fmt.Errorf("%w: %s", ErrPeerExists, newPublicKey.String())
+	}
+
+	// Swap the key in place, keeping addresses, delegated prefixes and the
+	// endpoint
+	err = configReplacePeerKey(config, publicKey, newPublicKey)
+	if err != nil {
+		return peer, err
+	}
+	err = device.RemovePeer(publicKey)
+	if err == nil {
+		rotated := peer
+		rotated.PublicKey = newPublicKey
+		err = device.AddPeer(rotated)
+		if err == nil {
+			return peer, nil
+		}
+		// The original peer was removed, so put it back
+		if rerr := device.RemovePeer(newPublicKey); rerr != nil {
+			log.Printf("Removing rotated peer %v failed: %v\n", newPublicKey, rerr)
+		}
+		if rerr := device.AddPeer(peer); rerr != nil {
+			log.Printf("Restoring peer %v failed: %v\n", publicKey, rerr)
+		}
+	}
+
+	// Restore the original key so the config matches the interface
+	if rerr := configReplacePeerKey(config, newPublicKey, publicKey); rerr != nil {
+		log.Printf("Restoring peer %v in the config failed: %v\n", publicKey, rerr)
+	}
+	return peer, err
+}
+
+// configReplacePeerKey replaces the public key of a peer, keeping its other
+// settings
+func configReplacePeerKey(config string, publicKey wgtypes.Key, newPublicKey wgtypes.Key) error {
+	return configEditPeer(config, publicKey, func(lines []string) []string {
+		for i, line := range lines {
+			key, _ := configSplitLine(line)
+			if strings.EqualFold(key, "PublicKey") {
+				lines[i] = "PublicKey = " + newPublicKey.String() + "\n"
+			}
+		}
+		return lines
+	})
+}
+
+// configUpdatePeer replaces the allowed IPs and preshared key of a peer with
+// those read from the interface, keeping its other settings
+func configUpdatePeer(config string, peer wgtypes.Peer) error {
+	return configEditPeer(config, peer.PublicKey, func(lines []string) []string {
+		var out []string
+		for _, line := range lines {
+			key, _ := configSplitLine(line)
+			if strings.EqualFold(key, "AllowedIPs") || strings.EqualFold(key, "PresharedKey") {
+				continue
+			}
+			out = append(out, line)
+			if strings.EqualFold(key, "PublicKey") {
+				out = append(out, "AllowedIPs = "+formatAllowedIPs(peer.AllowedIPs)+"\n")
+				if peer.PresharedKey != (wgtypes.Key{}) {
+					out = append(out, "PresharedKey = "+peer.PresharedKey.String()+"\n")
+				}
+			}
+		}
+		return out
+	})
+}
+
+// configRemovePeer removes the [Peer] section with the public key
+func configRemovePeer(config string, publicKey wgtypes.Key) error {
+	return configEditPeer(config, publicKey, func(lines []string) []string {
+		return nil
+	})
+}
+
+// removePeer removes a peer from the config and the interface
+func removePeer(device Device, config string, publicKey wgtypes.Key) error {
+	err := configRemovePeer(config, publicKey)
+	if err != nil {
+		return err
+	}
+	return device.RemovePeer(publicKey)
+}
+
+func configReadInterfacePrivateKey(config string) (wgtypes.Key, error) {
+	cfg, err := ini.Load(config)
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("read interface private key failed: %w", err)
+	}
+
+	b64PrivateKey := cfg.Section("Interface").Key("PrivateKey").String()
+	wgPrivateKey, err := wgtypes.ParseKey(b64PrivateKey)
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("read interface private key failed: %w", err)
+	}
+	return wgPrivateKey, nil
+}
+
+// Allocator assigns addresses to requests. Addresses are reserved from when
+// they are assigned until they are released, which happens when the request is
+// rejected or expires, or once the peer is in the config
+type Allocator interface {
+	Allocate() (net.IP, error)
+	// Reserve marks an address as assigned, such as to a request that was
+	// pending before a restart
+	Reserve(ip net.IP)
+	Release(ip net.IP)
+}
+
+// configAllocator assigns the first free address on the interface network.
+// Addresses of peers removed from the config are free to be assigned again
+type configAllocator struct {
+	sync.Mutex
+	network net.IPNet
+	config  string
+	// Addresses assigned to pending requests and the interface
+	reserved []net.IPNet
+}
+
+func (a *configAllocator) Allocate() (net.IP, error) {
+	a.Lock()
+	defer a.Unlock()
+
+	used, err := configReadAllowedIPs(a.config)
+	if err != nil {
+		return nil, err
+	}
+	used = append(used, a.reserved...)
+
+	ip, err := AllocateAddress(a.network, used)
+	if err != nil {
+		return nil, err
+	}
+	a.reserved = append(a.reserved, ipToIPNetWithHostMask(ip))
+	return ip, nil
+}
+
+func (a *configAllocator) Reserve(ip net.IP) {
+	a.Lock()
+	defer a.Unlock()
+	a.reserved = append(a.reserved, ipToIPNetWithHostMask(ip))
+}
+
+func (a *configAllocator) Release(ip net.IP) {
+	a.Lock()
+	defer a.Unlock()
+	a.reserved = removePrefixes(a.reserved, []net.IPNet{ipToIPNetWithHostMask(ip)})
+}
+
+// delegator delegates routed prefixes from the delegation pools
+type delegator struct {
+	sync.Mutex
+	pools  []net.IPNet
+	config string
+	// Prefixes delegated to pending requests and the interface network
+	reserved []net.IPNet
+}
+
+// delegate allocates a prefix of the requested length and validates each
+// advertised prefix against the pools, the existing peers in the config and
+// previously delegated prefixes
+func (d *delegator) delegate(length int, advertised []string) ([]net.IPNet, error) {
+	if length == 0 && len(advertised) == 0 {
+		return nil, nil
+	}
+
+	d.Lock()
+	defer d.Unlock()
+
+	used, err := configReadAllowedIPs(d.config)
+	if err != nil {
+		return nil, err
+	}
+	used = append(used, d.reserved...)
+
+	var prefixes []net.IPNet
+	for _, a := range advertised {
+		_, prefix, err := net.ParseCIDR(strings.TrimSpace(a))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrValueParse, err)
+		}
+		err = ValidatePrefix(d.pools, *prefix, used)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, *prefix)
+		used = append(used, *prefix)
+	}
+
+	if length > 0 {
+		prefix, err := AllocatePrefix(d.pools, length, used)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	d.reserved = append(d.reserved, prefixes...)
+	return prefixes, nil
+}
+
+// readEndpoints returns the endpoints of peers observed on the interface.
+// Endpoints are only known after the first handshake from the peer
+func readEndpoints(device Device) (map[string]PeerEndpoint, error) {
+	wgDevice, err := device.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make(map[string]PeerEndpoint)
+	for _, peer := range wgDevice.Peers {
+		if peer.Endpoint != nil {
+			endpoints[peer.PublicKey.String()] = PeerEndpoint{
+				PublicKey:         peer.PublicKey.String(),
+				Endpoint:          peer.Endpoint.String(),
+				LastHandshakeTime: peer.LastHandshakeTime,
+			}
+		}
+	}
+	return endpoints, nil
+}
+
+func (d *delegator) reserve(prefixes []net.IPNet) {
+	d.Lock()
+	defer d.Unlock()
+	d.reserved = append(d.reserved, prefixes...)
+}
+
+func (d *delegator) release(prefixes []net.IPNet) {
+	d.Lock()
+	defer d.Unlock()
+	d.reserved = removePrefixes(d.reserved, prefixes)
+}
+
+// removePrefixes returns the prefixes without those in remove
+func removePrefixes(prefixes []net.IPNet, remove []net.IPNet) []net.IPNet {
+	var kept []net.IPNet
+	for _, prefix := range prefixes {
+		removed := false
+		for _, r := range remove {
+			if prefix.String() == r.String() {
+				removed = true
+			}
+		}
+		if !removed {
+			kept = append(kept, prefix)
+		}
+	}
+	return kept
+}
+
+// splitAllowedIPs separates the address of a peer within the interface
+// network from prefixes delegated to the peer
+func splitAllowedIPs(allowedIPs []net.IPNet, interfIPNet *net.IPNet) (net.IP, []net.IPNet) {
+	var ip net.IP
+	var delegatedPrefixes []net.IPNet
+	for _, allowedIP := range allowedIPs {
+		ones, bits := allowedIP.Mask.Size()
+		if ip == nil && ones == bits && interfIPNet.Contains(allowedIP.IP) {
+			ip = allowedIP.IP
+			continue
+		}
+		delegatedPrefixes = append(delegatedPrefixes, allowedIP)
+	}
+	return ip, delegatedPrefixes
+}
+
+func ipToIPNetWithHostMask(ip net.IP) net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(32, 32),
+		}
+	}
+	return net.IPNet{
+		IP:   ip,
+		Mask: net.CIDRMask(128, 128),
+	}
+}
@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const serverNetdevTemplate = `
+[NetDev]
+Name = {{.InterfaceName}}
+Kind = wireguard
+Description = WireGuard {{.InterfaceName}} managed by wireguard-negotiator server
+
+[WireGuard]
+PrivateKeyFile = {{.PrivateKeyFile}}
+ListenPort = {{.ListenPort}}
+`
+
+const serverNetworkTemplate = `
+[Match]
+Name = {{.InterfaceName}}
+
+[Network]
+Address = {{.Address}}
+`
+
+// ServerInitOptions describes the interface created for a new server
+type ServerInitOptions struct {
+	InterfaceName string
+	// Path to the WireGuard configuration file, defaults to
+	// /etc/wireguard/<interface>.conf
+	ConfigPath string
+	// Address of the interface, from which the network is allocated to
+	// clients
+	Address    net.IPNet
+	ListenPort int
+	// Networkd writes systemd-networkd units, so that the interface is
+	// created again on boot. Otherwise the interface is created with ip
+	Networkd bool
+	// Path of the units without extension, defaults to
+	// /etc/systemd/network/<interface>
+	NetworkdPath  string
+	VerifyTimeout time.Duration
+	Runner        Runner
+	Device        DeviceConfigurer
+}
+
+// serverNetworkdConfig is rendered into the networkd units of the server
+type serverNetworkdConfig struct {
+	InterfaceName  string
+	PrivateKeyFile string
+	ListenPort     int
+	Address        string
+}
+
+// InitServer generates a private key, writes the configuration file for a
+// new server interface and brings the interface up. It returns the private
+// key of the interface
+func InitServer(options ServerInitOptions) (wgtypes.Key, error) {
+	if options.ConfigPath == "" {
+		options.ConfigPath = "/etc/wireguard/" + options.InterfaceName + ".conf"
+	}
+	if options.NetworkdPath == "" {
+		options.NetworkdPath = "/etc/systemd/network/" + options.InterfaceName
+	}
+	if options.Runner == nil {
+		options.Runner = ExecRunner{}
+	}
+	if options.Device == nil {
+		options.Device = WgctrlConfigurer{}
+	}
+	address := options.Address.String()
+
+	// Never overwrite an existing interface or configuration
+	paths := []string{options.ConfigPath}
+	if options.Networkd {
+		paths = append(paths, options.NetworkdPath+".netdev", options.NetworkdPath+".network", options.NetworkdPath+".key")
+	}
+	err := checkNotExist(paths...)
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+	if interfaceExists(options.InterfaceName) {
+		return wgtypes.Key{}, fmt.Errorf("%w: interface %s", os.ErrExist, options.InterfaceName)
+	}
+
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+	var config bytes.Buffer
+	err = WriteConfig(&config, wgtypes.Device{
+		PrivateKey: privateKey,
+		ListenPort: options.ListenPort,
+	}, nil)
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(options.ConfigPath), 0700)
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("creating %s failed: %w", filepath.Dir(options.ConfigPath), err)
+	}
+	files := fileSet{secrets: [][]byte{[]byte(privateKey.String())}}
+	files.stage(options.ConfigPath, config.Bytes(), 0600)
+	if options.Networkd {
+		data := serverNetworkdConfig{
+			InterfaceName:  options.InterfaceName,
+			PrivateKeyFile: options.NetworkdPath + ".key",
+			ListenPort:     options.ListenPort,
+			Address:        address,
+		}
+		netdev, err := renderTemplate("", "netdev", serverNetdevTemplate, data)
+		if err != nil {
+			return wgtypes.Key{}, err
+		}
+		network, err := renderTemplate("", "network", serverNetworkTemplate, data)
+		if err != nil {
+			return wgtypes.Key{}, err
+		}
+		files.stageGroup(data.PrivateKeyFile, []byte(privateKey.String()+"\n"), 0640, networkdGroup)
+		files.stage(options.NetworkdPath+".netdev", netdev, 0644)
+		files.stage(options.NetworkdPath+".network", network, 0644)
+	}
+	_, err = files.commit()
+	if err != nil {
+		return wgtypes.Key{}, err
+	}
+
+	if options.Networkd {
+		_, err = options.Runner.Run(nil, "systemctl", "restart", "systemd-networkd")
+	} else {
+		err = initServerLink(options, privateKey, address)
+	}
+	if err == nil {
+		err = waitInterface(options.InterfaceName, []string{address}, options.VerifyTimeout)
+	}
+	if err != nil {
+		if interfaceExists(options.InterfaceName) {
+			options.Runner.Run(nil, "ip", "link", "delete", options.InterfaceName)
+		}
+		files.rollback()
+		return wgtypes.Key{}, err
+	}
+	return privateKey, nil
+}
+
+// initServerLink creates the interface with ip, equivalent to wg-quick up
+func initServerLink(options ServerInitOptions, privateKey wgtypes.Key, address string) error {
+	_, err := options.Runner.Run(nil, "ip", "link", "add", options.InterfaceName, "type", "wireguard")
+	if err != nil {
+		return err
+	}
+	listenPort := options.ListenPort
+	err = options.Device.ConfigureDevice(options.InterfaceName, wgtypes.Config{
+		PrivateKey: &privateKey,
+		ListenPort: &listenPort,
+	})
+	if err != nil {
+		return err
+	}
+	commands := [][]string{
+		{"ip", "address", "add", address, "dev", options.InterfaceName},
+		{"ip", "link", "set", options.InterfaceName, "up"},
+	}
+	for _, command := range commands {
+		_, err := options.Runner.Run(nil, command[0], command[1:]...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// StateDir is the default directory for client state files
+const StateDir = "/var/lib/wireguard-negotiator"
+
+// State records what the client has set up, so that later commands can talk
+// to the server again and update the local configuration
+type State struct {
+	ServerURL string
+	Insecure  bool
+	// Paths to TLS files and the proxy URL of ClientOptions
+	CAFile        string `json:",omitempty"`
+	CertFile      string `json:",omitempty"`
+	KeyFile       string `json:",omitempty"`
+	Proxy         string `json:",omitempty"`
+	InterfaceName string
+	Type          string
+	PrivateKey    string
+	// New private key sent to the server by a rotation that has not finished
+	PendingPrivateKey string `json:",omitempty"`
+	ListenPort        int
+	Endpoint          string
+	// Path to backend configuration. For networkd, this is without extensions.
+	// For userspace, this is the pidfile. Empty paths are the backend defaults
+	ConfigPath          string
+	WireGuardConfigPath string `json:",omitempty"`
+	TemplateDir         string `json:",omitempty"`
+	TemplateCommand     string `json:",omitempty"`
+	// ID of a request that is not yet approved. Config is empty until then
+	RequestID string `json:",omitempty"`
+	Config    PeerConfigResponse
+}
+
+// DefaultStatePath returns the default path of the state file for an
+// interface
+func DefaultStatePath(inter string) string {
+	return filepath.Join(StateDir, inter+".json")
+}
+
+// ReadState reads the state file
+func ReadState(path string) (State, error) {
+	var state State
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return state, fmt.Errorf("reading %s failed: %w", path, err)
+	}
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return state, fmt.Errorf("reading %s failed: %w", path, err)
+	}
+	return state, nil
+}
+
+// WriteState replaces the state file. The state contains the private key, so
+// it is only readable by the owner
+func WriteState(path string, state State) error {
+	b, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return fmt.Errorf("creating %s failed: %w", filepath.Dir(path), err)
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return fmt.Errorf("writing %s failed: %w", tmp, err)
+	}
+	err = os.Rename(tmp, path)
+	if err != nil {
+		return fmt.Errorf("writing %s failed: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	RegisterBackend("template", newTemplateBackend)
+}
+
+// templateBackend renders every template file in the template directory into
+// the output directory, for formats without a built-in backend. File names are
+// also templates, so "{{.InterfaceName}}.conf.tmpl" renders to "wg0.conf"
+type templateBackend struct {
+	options BackendOptions
+	files   fileSet
+	changed bool
+}
+
+func newTemplateBackend(options BackendOptions) Backend {
+	if options.ConfigPath == "" {
+		options.ConfigPath = "/etc/wireguard"
+	}
+	return &templateBackend{options: options}
+}
+
+// outputs renders the output path of each template file
+func (b *templateBackend) outputs(config InterfaceAndPeerConfig) (map[string]string, error) {
+	if b.options.TemplateDir == "" {
+		return nil, fmt.Errorf("template directory not set")
+	}
+	entries, err := ioutil.ReadDir(b.options.TemplateDir)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s failed: %w", b.options.TemplateDir, err)
+	}
+
+	outputs := make(map[string]string)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), TemplateExt) {
+			continue
+		}
+		name, err := renderTemplate("", "file name", strings.TrimSuffix(entry.Name(), TemplateExt), config)
+		if err != nil {
+			return nil, err
+		}
+		outputs[entry.Name()] = filepath.Join(b.options.ConfigPath, filepath.Base(string(name)))
+	}
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("no %s files in %s", TemplateExt, b.options.TemplateDir)
+	}
+	return outputs, nil
+}
+
+func (b *templateBackend) Prepare() error {
+	outputs, err := b.outputs(InterfaceAndPeerConfig{InterfaceName: b.options.InterfaceName})
+	if err != nil {
+		return err
+	}
+	for _, path := range outputs {
+		err = checkNotExist(path)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *templateBackend) Write(config InterfaceAndPeerConfig) error {
+	outputs, err := b.outputs(config)
+	if err != nil {
+		return err
+	}
+
+	b.files = fileSet{secrets: config.secrets()}
+	for file, path := range outputs {
+		text, err := ioutil.ReadFile(filepath.Join(b.options.TemplateDir, file))
+		if err != nil {
+			return fmt.Errorf("reading %s failed: %w", file, err)
+		}
+		content, err := renderTemplate("", file, string(text), config)
+		if err != nil {
+			return err
+		}
+		// Templates may contain the private key
+		b.files.stage(path, content, 0600)
+	}
+	changed, err := b.files.commit()
+	if err != nil {
+		return err
+	}
+	b.changed = b.changed || changed
+	return nil
+}
+
+// Apply runs the template command, if there is one
+func (b *templateBackend) Apply() error {
+	if !b.changed {
+		return nil
+	}
+	err := b.run()
+	if err != nil {
+		return err
+	}
+	b.changed = false
+	return nil
+}
+
+func (b *templateBackend) Rollback() error {
+	err := b.files.rollback()
+	if err != nil {
+		return err
+	}
+	b.changed = false
+	return b.run()
+}
+
+func (b *templateBackend) Remove() error {
+	outputs, err := b.outputs(InterfaceAndPeerConfig{InterfaceName: b.options.InterfaceName})
+	if err != nil {
+		return err
+	}
+	for _, path := range outputs {
+		err = removeFiles(path)
+		if err != nil {
+			return err
+		}
+	}
+	return b.run()
+}
+
+func (b *templateBackend) run() error {
+	if b.options.TemplateCommand == "" {
+		return nil
+	}
+	_, err := b.options.Runner.Run(nil, "sh", "-c", b.options.TemplateCommand)
+	return err
+}
@@ -1,9 +1,116 @@
 package lib
 
+import "time"
+
+// ProtocolVersion is the version of the /v1/ API
+const ProtocolVersion = 1
+
+// Capabilities of a server, listed by GET /v1/info
+const (
+	CapabilityAsyncRequest     = "async-request"
+	CapabilitySync             = "sync"
+	CapabilityRotate           = "rotate"
+	CapabilityLeave            = "leave"
+	CapabilityMesh             = "mesh"
+	CapabilityPrefixDelegation = "prefix-delegation"
+	CapabilityPresharedKey     = "preshared-key"
+	CapabilityPing             = "ping"
+)
+
+// ServerInfo describes the protocol and features of a server
+type ServerInfo struct {
+	ProtocolVersion int
+	Capabilities    []string
+}
+
+type PeerConfigRequest struct {
+	PublicKey            string
+	Endpoint             string
+	DelegatePrefixLength int
+	AdvertisedPrefixes   []string
+}
+
 type PeerConfigResponse struct {
-	InterfaceIPs        []string
-	AllowedIPs          []string
+	InterfaceIPs []string
+	AllowedIPs   []string
+	PublicKey    string
+	// Optional key shared with the server peer, for post-quantum resistance
+	PresharedKey        string
+	Endpoint            string
+	PersistentKeepalive int
+	DelegatedPrefixes   []string
+	Routes              []string
+	DNS                 []string
+	DNSSearch           []string
+	MTU                 int
+	Peers               []PeerConfig
+	// Address of the server within the tunnel, and the URL to probe it
+	// through the tunnel
+	ServerIP string
+	PingURL  string
+	// Version of the server configuration, used to wait for changes
+	Version int64
+}
+
+// Codes of errors returned by the server in ErrorResponse
+const (
+	ErrorInvalidRequest = "invalid-request"
+	ErrorDuplicateKey   = "duplicate-key"
+	ErrorPrefixOverlaps = "prefix-overlaps"
+	ErrorPoolExhausted  = "pool-exhausted"
+	ErrorUnauthorized   = "unauthorized"
+	ErrorRevoked        = "revoked"
+	ErrorNotFound       = "not-found"
+	ErrorUnavailable    = "unavailable"
+	ErrorRejected       = "rejected"
+	ErrorExpired        = "expired"
+)
+
+// ErrorResponse is the body of unsuccessful responses
+type ErrorResponse struct {
+	Error   string
+	Message string `json:",omitempty"`
+}
+
+// RotateRequest replaces the public key of an enrolled peer
+type RotateRequest struct {
+	PublicKey string
+}
+
+// Statuses of an enrollment request. Requests stay pending until the server
+// admin decides
+const (
+	StatusPending  = "pending"
+	StatusApproved = "approved"
+	StatusRejected = "rejected"
+	StatusExpired  = "expired"
+	// The server shut down without a store to keep the request pending
+	StatusCancelled = "cancelled"
+)
+
+// PeerConfigRequestStatus is the status of an enrollment request. Config is
+// only set once the request is approved
+type PeerConfigRequestStatus struct {
+	ID     string
+	Status string
+	Config *PeerConfigResponse `json:",omitempty"`
+}
+
+// PeerEndpoint is the endpoint of a peer as observed by the server
+type PeerEndpoint struct {
+	PublicKey         string
+	Endpoint          string
+	LastHandshakeTime time.Time
+}
+
+type PeerEndpointsResponse struct {
+	Peers []PeerEndpoint
+}
+
+// PeerConfig describes another peer to configure directly, used in mesh mode
+type PeerConfig struct {
 	PublicKey           string
 	Endpoint            string
+	AllowedIPs          []string
 	PersistentKeepalive int
 }
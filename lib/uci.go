@@ -0,0 +1,187 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+func init() {
+	RegisterBackend("uci", newUCIBackend)
+}
+
+// uciTemplate renders a uci batch script. Routes are installed by netifd from
+// the AllowedIPs of each peer, including a host route to the endpoint
+const uciTemplate = `set network.{{.InterfaceName}}=interface
+set network.{{.InterfaceName}}.proto='wireguard'
+set network.{{.InterfaceName}}.private_key={{uciQuote .PrivateKey}}
+{{- if .ListenPort}}
+set network.{{.InterfaceName}}.listen_port='{{.ListenPort}}'
+{{- end}}
+{{- if .MTU}}
+set network.{{.InterfaceName}}.mtu='{{.MTU}}'
+{{- end}}
+{{- range .InterfaceIPs}}
+add_list network.{{$.InterfaceName}}.addresses={{uciQuote .}}
+{{- end}}
+{{- range .DNS}}
+add_list network.{{$.InterfaceName}}.dns={{uciQuote .}}
+{{- end}}
+{{- range .DNSSearch}}
+add_list network.{{$.InterfaceName}}.dns_search={{uciQuote .}}
+{{- end}}
+set network.wireguard_{{.InterfaceName}}_server=wireguard_{{.InterfaceName}}
+set network.wireguard_{{.InterfaceName}}_server.description='wireguard-negotiator server'
+set network.wireguard_{{.InterfaceName}}_server.public_key={{uciQuote .PublicKey}}
+{{- if .PresharedKey}}
+set network.wireguard_{{.InterfaceName}}_server.preshared_key={{uciQuote .PresharedKey}}
+{{- end}}
+set network.wireguard_{{.InterfaceName}}_server.endpoint_host={{uciQuote (endpointHost .Endpoint)}}
+set network.wireguard_{{.InterfaceName}}_server.endpoint_port={{uciQuote (endpointPort .Endpoint)}}
+set network.wireguard_{{.InterfaceName}}_server.persistent_keepalive='{{.PersistentKeepalive}}'
+set network.wireguard_{{.InterfaceName}}_server.route_allowed_ips='1'
+{{- range .AllowedIPs}}
+add_list network.wireguard_{{$.InterfaceName}}_server.allowed_ips={{uciQuote .}}
+{{- end}}
+{{- range .Peers}}
+add network wireguard_{{$.InterfaceName}}
+set network.@wireguard_{{$.InterfaceName}}[-1].public_key={{uciQuote .PublicKey}}
+{{- if .Endpoint}}
+set network.@wireguard_{{$.InterfaceName}}[-1].endpoint_host={{uciQuote (endpointHost .Endpoint)}}
+set network.@wireguard_{{$.InterfaceName}}[-1].endpoint_port={{uciQuote (endpointPort .Endpoint)}}
+{{- end}}
+{{- if .PersistentKeepalive}}
+set network.@wireguard_{{$.InterfaceName}}[-1].persistent_keepalive='{{.PersistentKeepalive}}'
+{{- end}}
+set network.@wireguard_{{$.InterfaceName}}[-1].route_allowed_ips='1'
+{{- range .AllowedIPs}}
+add_list network.@wireguard_{{$.InterfaceName}}[-1].allowed_ips={{uciQuote .}}
+{{- end}}
+{{- end}}
+commit network
+`
+
+// uciBackend configures the network package of OpenWrt with uci. ConfigPath is
+// the file of the network package
+type uciBackend struct {
+	options BackendOptions
+	config  InterfaceAndPeerConfig
+	// Export of the network package before Write, for rollback
+	previous []byte
+}
+
+func newUCIBackend(options BackendOptions) Backend {
+	if options.ConfigPath == "" {
+		options.ConfigPath = "/etc/config/network"
+	}
+	return &uciBackend{options: options}
+}
+
+// Prepare ensures that the interface is not already configured
+func (b *uciBackend) Prepare() error {
+	inter := b.options.InterfaceName
+	_, err := b.options.Runner.Run(nil, "uci", "-q", "get", "network."+inter)
+	if err == nil {
+		return fmt.Errorf("network.%s already exists", inter)
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return err
+	}
+	return nil
+}
+
+// Write replaces the sections of the interface and its peers
+func (b *uciBackend) Write(config InterfaceAndPeerConfig) error {
+	commands, err := renderTemplate(b.options.TemplateDir, "uci", uciTemplate, config)
+	if err != nil {
+		return err
+	}
+	batch, err := b.deleteCommands()
+	if err != nil {
+		return err
+	}
+	batch = append(batch, commands...)
+
+	// The network package will contain the private key, so never write it
+	// into a file readable by others
+	err = restrictFile(b.options.ConfigPath)
+	if err != nil {
+		return err
+	}
+	previous, err := b.options.Runner.Run(nil, "uci", "export", "network")
+	if err != nil {
+		return err
+	}
+	b.previous = previous
+	b.config = config
+	_, err = b.options.Runner.Run(batch, "uci", "batch")
+	return err
+}
+
+// deleteCommands returns uci batch commands that delete the interface section
+// and its peer sections
+func (b *uciBackend) deleteCommands() ([]byte, error) {
+	// Show anonymous sections by name, so that deleting one does not change
+	// the index of others
+	show, err := b.options.Runner.Run(nil, "uci", "-X", "show", "network")
+	if err != nil {
+		return nil, err
+	}
+
+	inter := b.options.InterfaceName
+	var deletes bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(show))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), "=", 2)
+		if len(parts) != 2 || strings.Count(parts[0], ".") != 1 {
+			continue
+		}
+		section := parts[0]
+		sectionType := strings.Trim(parts[1], "'")
+		if section == "network."+inter || sectionType == "wireguard_"+inter {
+			fmt.Fprintf(&deletes, "delete %s\n", section)
+		}
+	}
+	return deletes.Bytes(), nil
+}
+
+func (b *uciBackend) Apply() error {
+	err := b.reload()
+	if err != nil {
+		return err
+	}
+	return b.options.verify(b.config)
+}
+
+func (b *uciBackend) reload() error {
+	_, err := b.options.Runner.Run(nil, "/etc/init.d/network", "reload")
+	return err
+}
+
+func (b *uciBackend) Rollback() error {
+	if b.previous == nil {
+		return nil
+	}
+	_, err := b.options.Runner.Run(b.previous, "uci", "import", "network")
+	if err != nil {
+		return err
+	}
+	b.previous = nil
+	return b.reload()
+}
+
+func (b *uciBackend) Remove() error {
+	deletes, err := b.deleteCommands()
+	if err != nil {
+		return err
+	}
+	_, err = b.options.Runner.Run(append(deletes, "commit network\n"...), "uci", "batch")
+	if err != nil {
+		return err
+	}
+	return b.reload()
+}
@@ -0,0 +1,206 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+func init() {
+	RegisterBackend("userspace", newUserspaceBackend)
+}
+
+// DefaultPidfilePath is the path of the pidfile of the userspace daemon for
+// the interface
+func DefaultPidfilePath(inter string) string {
+	return "/run/wireguard-negotiator/" + inter + ".pid"
+}
+
+// userspaceBackend runs the interface in a daemon that reads the state file,
+// so Apply must be called after the state is saved
+type userspaceBackend struct {
+	options BackendOptions
+	config  InterfaceAndPeerConfig
+	// Whether the daemon was running before Write
+	running bool
+}
+
+func newUserspaceBackend(options BackendOptions) Backend {
+	if options.ConfigPath == "" {
+		options.ConfigPath = DefaultPidfilePath(options.InterfaceName)
+	}
+	if options.StatePath == "" {
+		options.StatePath = DefaultStatePath(options.InterfaceName)
+	}
+	return &userspaceBackend{options: options}
+}
+
+func (b *userspaceBackend) Prepare() error {
+	if _, err := net.InterfaceByName(b.options.InterfaceName); err == nil {
+		return fmt.Errorf("interface %s already exists", b.options.InterfaceName)
+	}
+	return nil
+}
+
+func (b *userspaceBackend) Write(config InterfaceAndPeerConfig) error {
+	b.config = config
+	_, err := net.InterfaceByName(b.options.InterfaceName)
+	b.running = err == nil
+	return nil
+}
+
+// Apply starts the daemon, or updates the keys and peers of a running daemon.
+// Changes to addresses and routes take effect when the daemon is restarted
+func (b *userspaceBackend) Apply() error {
+	if !b.running {
+		err := RunUserspace(b.options.StatePath, b.options.ConfigPath, b.options.Foreground)
+		// A foreground interface has already been stopped
+		if err != nil || b.options.Foreground {
+			return err
+		}
+	} else {
+		wgConfig, err := b.config.DeviceConfig()
+		if err != nil {
+			return err
+		}
+		err = b.options.Device.ConfigureDevice(b.options.InterfaceName, wgConfig)
+		if err != nil {
+			return err
+		}
+	}
+	return b.options.verify(b.config)
+}
+
+func (b *userspaceBackend) Rollback() error {
+	if b.running {
+		return nil
+	}
+	return stopUserspace(b.options.ConfigPath)
+}
+
+func (b *userspaceBackend) Remove() error {
+	return stopUserspace(b.options.ConfigPath)
+}
+
+// RunUserspace runs the interface described by the state file until
+// terminated, or starts a daemon that does so
+func RunUserspace(statePath string, pidfile string, foreground bool) error {
+	if !foreground {
+		return daemonizeUserspace(statePath, pidfile)
+	}
+
+	state, err := ReadState(statePath)
+	if err != nil {
+		return err
+	}
+	config := InterfaceAndPeerConfig{
+		PeerConfigResponse: state.Config,
+		PrivateKey:         state.PrivateKey,
+		InterfaceName:      state.InterfaceName,
+		ListenPort:         state.ListenPort,
+	}
+
+	dev, err := StartUserspaceDevice(config.InterfaceName, config.MTU)
+	if err != nil {
+		return err
+	}
+	defer dev.Close()
+
+	err = interConfigureDevice(config)
+	if err != nil {
+		return err
+	}
+	err = interConfigureLink(config)
+	if err != nil {
+		return err
+	}
+	defer interUnconfigureLink(config)
+
+	err = os.MkdirAll(filepath.Dir(pidfile), 0755)
+	if err != nil {
+		return fmt.Errorf("creating %s failed: %w", filepath.Dir(pidfile), err)
+	}
+	err = ioutil.WriteFile(pidfile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("writing %s failed: %w", pidfile, err)
+	}
+	defer os.Remove(pidfile)
+
+	go func() {
+		term := make(chan os.Signal, 1)
+		signal.Notify(term, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+		<-term
+		dev.Close()
+	}()
+
+	log.Printf("Userspace interface %v started\n", config.InterfaceName)
+	return dev.Wait()
+}
+
+// interConfigureDevice configures keys and peers on the interface
+func interConfigureDevice(config InterfaceAndPeerConfig) error {
+	wgConfig, err := config.DeviceConfig()
+	if err != nil {
+		return err
+	}
+	return WgctrlConfigurer{}.ConfigureDevice(config.InterfaceName, wgConfig)
+}
+
+// interConfigureLink configures addresses, routes and DNS on the interface,
+// like the other backends do through their network managers
+func interConfigureLink(config InterfaceAndPeerConfig) error {
+	inter := config.InterfaceName
+	commands := [][]string{
+		{"ip", "link", "set", inter, "up"},
+	}
+	for _, address := range config.InterfaceIPs {
+		commands = append(commands, []string{"ip", "address", "add", address, "dev", inter})
+	}
+	for _, route := range WithoutDefaultRoutes(config.Routes) {
+		commands = append(commands, []string{"ip", "route", "add", route, "dev", inter})
+	}
+	if config.FullTunnel() {
+		for _, family := range []string{"-4", "-6"} {
+			commands = append(commands,
+				[]string{"ip", family, "route", "add", "default", "dev", inter, "table", strconv.Itoa(FullTunnelTable)},
+				[]string{"ip", family, "rule", "add", "not", "fwmark", strconv.Itoa(FullTunnelMark), "table", strconv.Itoa(FullTunnelTable)},
+				[]string{"ip", family, "rule", "add", "table", "main", "suppress_prefixlength", "0"},
+			)
+		}
+	}
+	if len(config.DNS) > 0 {
+		commands = append(commands, append([]string{"resolvectl", "dns", inter}, config.DNS...))
+	}
+	if len(config.DNSSearch) > 0 {
+		commands = append(commands, append([]string{"resolvectl", "domain", inter}, config.DNSSearch...))
+	}
+
+	for _, command := range commands {
+		cmd := exec.Command(command[0], command[1:]...)
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("%s failed: %w", strings.Join(command, " "), err)
+		}
+	}
+	return nil
+}
+
+// interUnconfigureLink removes policy routing rules, which are not removed
+// with the interface
+func interUnconfigureLink(config InterfaceAndPeerConfig) {
+	if !config.FullTunnel() {
+		return
+	}
+	for _, family := range []string{"-4", "-6"} {
+		exec.Command("ip", family, "rule", "del", "not", "fwmark", strconv.Itoa(FullTunnelMark), "table", strconv.Itoa(FullTunnelTable)).Run()
+		exec.Command("ip", family, "rule", "del", "table", "main", "suppress_prefixlength", "0").Run()
+	}
+}
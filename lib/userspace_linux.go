@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/ipc"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+// UserspaceDevice is a WireGuard interface implemented in-process by
+// wireguard-go on a TUN device, for hosts without the kernel module. It is
+// configured through the UAPI socket, which wgctrl and wg also use
+type UserspaceDevice struct {
+	device *device.Device
+	uapi   net.Listener
+	errs   chan error
+}
+
+// StartUserspaceDevice creates the TUN device and starts listening on the
+// UAPI socket. An MTU of 0 uses the wireguard-go default
+func StartUserspaceDevice(name string, mtu int) (*UserspaceDevice, error) {
+	if mtu == 0 {
+		mtu = device.DefaultMTU
+	}
+
+	tunDevice, err := tun.CreateTUN(name, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("create TUN %s failed: %w", name, err)
+	}
+
+	fileUAPI, err := ipc.UAPIOpen(name)
+	if err != nil {
+		tunDevice.Close()
+		return nil, fmt.Errorf("open UAPI %s failed: %w", name, err)
+	}
+
+	logger := device.NewLogger(device.LogLevelError, fmt.Sprintf("(%s) ", name))
+	d := &UserspaceDevice{
+		device: device.NewDevice(tunDevice, logger),
+		errs:   make(chan error, 1),
+	}
+
+	d.uapi, err = ipc.UAPIListen(name, fileUAPI)
+	if err != nil {
+		d.device.Close()
+		return nil, fmt.Errorf("listen on UAPI %s failed: %w", name, err)
+	}
+	go func() {
+		for {
+			conn, err := d.uapi.Accept()
+			if err != nil {
+				d.errs <- err
+				return
+			}
+			go d.device.IpcHandle(conn)
+		}
+	}()
+
+	return d, nil
+}
+
+// Wait returns when the device is closed or the UAPI socket fails
+func (d *UserspaceDevice) Wait() error {
+	select {
+	case <-d.device.Wait():
+		return nil
+	case err := <-d.errs:
+		return err
+	}
+}
+
+// Close removes the UAPI socket and the TUN device
+func (d *UserspaceDevice) Close() {
+	d.uapi.Close()
+	d.device.Close()
+}
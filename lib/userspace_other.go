@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package lib
+
+import "fmt"
+
+var ErrUserspaceNotSupported = fmt.Errorf("userspace WireGuard is only supported on Linux")
+
+type UserspaceDevice struct{}
+
+func StartUserspaceDevice(name string, mtu int) (*UserspaceDevice, error) {
+	return nil, ErrUserspaceNotSupported
+}
+
+func (d *UserspaceDevice) Wait() error {
+	return ErrUserspaceNotSupported
+}
+
+func (d *UserspaceDevice) Close() {}
@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+var ErrNoHandshake = fmt.Errorf("no handshake with the server")
+var ErrServerUnreachable = fmt.Errorf("handshake completed but the server is not reachable through the tunnel")
+
+// DefaultConnectTimeout is how long to wait for the tunnel to work after
+// enrollment
+const DefaultConnectTimeout = 30 * time.Second
+
+const probeTimeout = 2 * time.Second
+
+// VerifyConnection waits for a handshake with the server peer on the
+// interface, then probes the server through the tunnel. The probes also cause
+// WireGuard to initiate the handshake. Errors explain what is likely wrong
+func VerifyConnection(inter string, config PeerConfigResponse, timeout time.Duration) error {
+	return verifyDevice(WgctrlDevice{Name: inter}, config, timeout)
+}
+
+// verifyDevice is VerifyConnection on a Device
+func verifyDevice(wg Device, config PeerConfigResponse, timeout time.Duration) error {
+	serverPublicKey, err := wgtypes.ParseKey(config.PublicKey)
+	if err != nil {
+		return fmt.Errorf("server public key not valid: %w", err)
+	}
+
+	// The probe must go through the tunnel, not a proxy, and carries nothing
+	// secret
+	probe := &http.Client{
+		Transport: &http.Transport{Proxy: nil},
+		Timeout:   probeTimeout,
+	}
+
+	deadline := time.Now().Add(timeout)
+	handshake := false
+	var probeErr error
+	for {
+		if config.PingURL != "" {
+			probeErr = ping(probe, config.PingURL)
+		}
+
+		device, err := wg.Read()
+		if err != nil {
+			return err
+		}
+		for _, peer := range device.Peers {
+			if peer.PublicKey == serverPublicKey && !peer.LastHandshakeTime.IsZero() {
+				handshake = true
+			}
+		}
+
+		if handshake && probeErr == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+
+	if !handshake {
+		return fmt.Errorf("%w within %v: check that UDP to %s is not blocked, that the server public key is correct, and that the server has added this peer", ErrNoHandshake, timeout, config.Endpoint)
+	}
+	return fmt.Errorf("%w: %v: check routes to %s and the firewall on the server", ErrServerUnreachable, probeErr, config.ServerIP)
+}
+
+func ping(client *http.Client, url string) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("%s returned %v", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package lib
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+func TestVerifyConnection(t *testing.T) {
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	endpoint := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820}
+	pinged := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer pinged.Close()
+	unreachable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer unreachable.Close()
+
+	tests := []struct {
+		name      string
+		handshake bool
+		pingURL   string
+		want      error
+	}{
+		{"no handshake", false, "", ErrNoHandshake},
+		{"no handshake with ping", false, pinged.URL, ErrNoHandshake},
+		{"handshake", true, "", nil},
+		{"handshake with ping", true, pinged.URL, nil},
+		{"handshake with failed ping", true, unreachable.URL, ErrServerUnreachable},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			device := NewMemoryDevice("wgntest0")
+			err := device.AddPeer(wgtypes.PeerConfig{PublicKey: serverKey.PublicKey()})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.handshake {
+				err = device.SetEndpoint(serverKey.PublicKey(), endpoint)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err = verifyDevice(device, PeerConfigResponse{
+				PublicKey: serverKey.PublicKey().String(),
+				Endpoint:  endpoint.String(),
+				ServerIP:  "10.0.0.1",
+				PingURL:   test.pingURL,
+			}, 0)
+			if !errors.Is(err, test.want) {
+				t.Errorf("got error %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestVerifyConnectionWaits(t *testing.T) {
+	serverKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := NewMemoryDevice("wgntest0")
+	err = device.AddPeer(wgtypes.PeerConfig{PublicKey: serverKey.PublicKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := PeerConfigResponse{
+		PublicKey: serverKey.PublicKey().String(),
+		Endpoint:  "192.0.2.1:51820",
+	}
+
+	// The handshake does not complete within the timeout
+	start := time.Now()
+	err = verifyDevice(device, config, 500*time.Millisecond)
+	if !errors.Is(err, ErrNoHandshake) {
+		t.Fatalf("got error %v, want %v", err, ErrNoHandshake)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond {
+		t.Errorf("gave up after %v, before the timeout", elapsed)
+	}
+
+	// The handshake completes while waiting
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		device.SetEndpoint(serverKey.PublicKey(), &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 51820})
+	}()
+	err = verifyDevice(device, config, 5*time.Second)
+	if err != nil {
+		t.Errorf("verify failed: %v", err)
+	}
+}
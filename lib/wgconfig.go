@@ -151,35 +151,43 @@ func ReadConfig(r io.Reader) (wgtypes.Config, EndpointMap, error) {
 	return config, endpointMap, nil
 }
 
-// WriteConfig writes out WireGuard Device configuration into a buffer
-func WriteConfig(w io.Writer, config wgtypes.Device, endpointMap EndpointMap) {
+// WriteConfig writes out WireGuard Device configuration into a buffer,
+// returning the first error from the writer
+func WriteConfig(w io.Writer, config wgtypes.Device, endpointMap EndpointMap) error {
 	var emptyKey [wgtypes.KeyLen]byte
+	var err error
+	write := func(line string) {
+		if err == nil {
+			_, err = writeConfigLine(w, line)
+		}
+	}
 
-	writeConfigLine(w, formatSection("Interface"))
+	write(formatSection("Interface"))
 
-	writeConfigLine(w, formatLineKeyValue("PrivateKey", config.PrivateKey.String()))
+	write(formatLineKeyValue("PrivateKey", config.PrivateKey.String()))
 	if config.ListenPort > 0 {
-		writeConfigLine(w, formatLineKeyValue("ListenPort", formatPort(config.ListenPort)))
+		write(formatLineKeyValue("ListenPort", formatPort(config.ListenPort)))
 	}
 	if config.FirewallMark > 0 {
-		writeConfigLine(w, formatLineKeyValue("FwMark", formatFwMark(config.FirewallMark)))
+		write(formatLineKeyValue("FwMark", formatFwMark(config.FirewallMark)))
 	}
 
 	for _, peer := range config.Peers {
-		writeConfigLine(w, "")
-		writeConfigLine(w, formatSection("Peer"))
-		writeConfigLine(w, formatLineKeyValue("PublicKey", peer.PublicKey.String()))
+		write("")
+		write(formatSection("Peer"))
+		write(formatLineKeyValue("PublicKey", peer.PublicKey.String()))
 		if !bytes.Equal(peer.PresharedKey[:], emptyKey[:]) {
-			writeConfigLine(w, formatLineKeyValue("PresharedKey", peer.PresharedKey.String()))
+			write(formatLineKeyValue("PresharedKey", peer.PresharedKey.String()))
 		}
-		writeConfigLine(w, formatLineKeyValue("AllowedIPs", formatAllowedIPs(peer.AllowedIPs)))
+		write(formatLineKeyValue("AllowedIPs", formatAllowedIPs(peer.AllowedIPs)))
 		if peer.PersistentKeepaliveInterval > 0 {
-			writeConfigLine(w, formatLineKeyValue("PersistentKeepalive", formatPersistentKeepalive(peer.PersistentKeepaliveInterval)))
+			write(formatLineKeyValue("PersistentKeepalive", formatPersistentKeepalive(peer.PersistentKeepaliveInterval)))
 		}
 		if peer.Endpoint != nil {
-			writeConfigLine(w, formatLineKeyValue("Endpoint", endpointMap.revert(*peer.Endpoint)))
+			write(formatLineKeyValue("Endpoint", endpointMap.revert(*peer.Endpoint)))
 		}
 	}
+	return err
 }
 
 func readConfigLine(text string) (line, comments string) {
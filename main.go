@@ -18,6 +18,9 @@ func main() {
 			cmd.CmdServer,
 			cmd.CmdRequest,
 			cmd.CmdDump,
+			cmd.CmdAgent,
+			cmd.CmdLeave,
+			cmd.CmdUserspace,
 		},
 	}
 